@@ -0,0 +1,455 @@
+package cellar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// backupManifestName is the first entry of the backup archive
+	backupManifestName = "manifest.json"
+	dbFileName         = "data.mdb"
+	dbLockFileName     = "lock.mdb"
+)
+
+// snapshotAttempts is how many times the snapshot is retaken when
+// the writer removes the files in the middle of it
+const snapshotAttempts = 5
+
+// BackupFile is a file of the store captured by the backup
+type BackupFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// BackupManifest describes the store captured by the snapshot or the
+// backup. It is JSON-friendly, so it could be kept for the next
+// incremental backup
+type BackupManifest struct {
+	// ID identifies the backup, incremental backups refer to it
+	ID string `json:"id"`
+	// Since is the ID of the backup that this incremental
+	// backup builds upon, empty for the full backup
+	Since     string `json:"since,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	// Chunks are all chunk files of the store, including the ones
+	// shipped by the previous backups
+	Chunks []BackupFile `json:"chunks"`
+	// Buffer is the checkpointed part of the buffer, nil if there is none
+	Buffer *BackupFile `json:"buffer,omitempty"`
+	// EndPos is the position of the last captured checkpoint
+	EndPos int64 `json:"endPos"`
+}
+
+// capture is a consistent cut of the store: the copy of the metadata
+// DB and the files it refers to. Files are kept open, so they could be
+// read even if the writer removes them afterwards
+type capture struct {
+	manifest *BackupManifest
+	files    map[string]*os.File
+}
+
+func (c *capture) close() {
+	for _, f := range c.files {
+		f.Close()
+	}
+}
+
+func newBackupID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "rand.Read")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// capture copies the metadata DB into the folder and opens the files
+// that the copy refers to. The chunks in the previous manifest are
+// skipped. The cut is retaken if the writer seals the buffer, rotates
+// or truncates the chunks in the middle of it
+func (r *Reader) capture(dbFolder string, prev *BackupManifest) (*capture, error) {
+	for attempt := 1; ; attempt++ {
+		c, err := r.tryCapture(dbFolder, prev)
+		if err == nil {
+			return c, nil
+		}
+		if !os.IsNotExist(errors.Cause(err)) || attempt == snapshotAttempts {
+			return nil, err
+		}
+		for _, name := range []string{dbFileName, dbLockFileName} {
+			if err = os.Remove(path.Join(dbFolder, name)); err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrap(err, "Remove")
+			}
+		}
+	}
+}
+
+func (r *Reader) tryCapture(dbFolder string, prev *BackupManifest) (*capture, error) {
+
+	var err error
+
+	var db *mdb.DB
+	if db, err = mdb.New(r.Folder, mdb.NewConfig()); err != nil {
+		return nil, errors.Wrap(err, "mdb.New")
+	}
+	// copy is taken within a read transaction, so it is consistent
+	err = db.Env.Copy(dbFolder)
+	db.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "Env.Copy")
+	}
+
+	var copied *mdb.DB
+	if copied, err = mdb.New(dbFolder, mdb.NewConfig()); err != nil {
+		return nil, errors.Wrap(err, "mdb.New copy")
+	}
+	defer copied.Close()
+
+	var b *BufferDto
+	var chunks []*ChunkDto
+	err = copied.Read(func(tx *mdb.Tx) error {
+		var err error
+		if chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &BackupManifest{CreatedAt: time.Now().Unix()}
+	if m.ID, err = newBackupID(); err != nil {
+		return nil, err
+	}
+
+	shipped := make(map[string]int64)
+	if prev != nil {
+		m.Since = prev.ID
+		for _, f := range prev.Chunks {
+			shipped[f.Name] = f.Size
+		}
+	}
+
+	c := &capture{manifest: m, files: make(map[string]*os.File)}
+
+	open := func(name string, size int64) error {
+		f, err := os.Open(path.Join(r.Folder, name))
+		if err != nil {
+			return errors.Wrap(err, "Open")
+		}
+		c.files[name] = f
+		stat, err := f.Stat()
+		if err != nil {
+			return errors.Wrap(err, "Stat")
+		}
+		if stat.Size() < size {
+			return errors.Wrapf(ErrShortRead, "%s has %d bytes instead of %d", name, stat.Size(), size)
+		}
+		return nil
+	}
+
+	for _, chunk := range chunks {
+		m.Chunks = append(m.Chunks, BackupFile{chunk.FileName, chunk.CompressedDiskSize})
+		m.EndPos = chunk.StartPos + chunk.UncompressedByteSize
+
+		if size, found := shipped[chunk.FileName]; found && size == chunk.CompressedDiskSize {
+			continue
+		}
+		if err = open(chunk.FileName, chunk.CompressedDiskSize); err != nil {
+			c.close()
+			return nil, errors.Wrapf(err, "chunk %s", chunk.FileName)
+		}
+	}
+
+	if b != nil {
+		m.Buffer = &BackupFile{b.FileName, b.Pos}
+		m.EndPos = b.StartPos + b.Pos
+		// bytes before the checkpoint don't change till the seal
+		if err = open(b.FileName, b.Pos); err != nil {
+			c.close()
+			return nil, errors.Wrapf(err, "buffer %s", b.FileName)
+		}
+	}
+	return c, nil
+}
+
+// ensureEmptyFolder creates the folder if needed, making sure
+// it has nothing to overwrite
+func ensureEmptyFolder(folder string) error {
+	if err := ensureFolder(folder); err != nil {
+		return errors.Wrap(err, "ensureFolder")
+	}
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return errors.Wrap(err, "ReadDir")
+	}
+	if len(files) > 0 {
+		return errors.Wrapf(ErrInvalidOptions, "%s is not empty", folder)
+	}
+	return nil
+}
+
+// copyFile writes the first bytes of the file into a new file
+func copyFile(src *os.File, loc string, size int64) error {
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "Seek")
+	}
+
+	dst, err := os.Create(loc)
+	if err != nil {
+		return errors.Wrap(err, "Create")
+	}
+	defer dst.Close()
+
+	if _, err = io.CopyN(dst, src, size); err != nil {
+		return errors.Wrap(err, "CopyN")
+	}
+	if err = dst.Sync(); err != nil {
+		return errors.Wrap(err, "Sync")
+	}
+	return dst.Close()
+}
+
+// Snapshot copies the store into the empty folder at the last
+// checkpoint. It is safe to call while the writer is running: the
+// metadata DB is copied within a transaction, immutable chunks are
+// hard-linked (copied if the link fails) and the buffer is cut at the
+// checkpoint. The copy is a regular store, taking it needs no key.
+func (r *Reader) Snapshot(dstFolder string) (*BackupManifest, error) {
+
+	var err error
+
+	if err = ensureEmptyFolder(dstFolder); err != nil {
+		return nil, err
+	}
+
+	var c *capture
+	if c, err = r.capture(dstFolder, nil); err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	m := c.manifest
+	for _, chunk := range m.Chunks {
+		loc := path.Join(dstFolder, chunk.Name)
+		if err = os.Link(path.Join(r.Folder, chunk.Name), loc); err == nil {
+			continue
+		}
+		// chunk could have been removed since it was opened
+		if err = copyFile(c.files[chunk.Name], loc, chunk.Size); err != nil {
+			return nil, errors.Wrapf(err, "copy chunk %s", chunk.Name)
+		}
+	}
+	if m.Buffer != nil {
+		loc := path.Join(dstFolder, m.Buffer.Name)
+		if err = copyFile(c.files[m.Buffer.Name], loc, m.Buffer.Size); err != nil {
+			return nil, errors.Wrapf(err, "copy buffer %s", m.Buffer.Name)
+		}
+	}
+	return m, nil
+}
+
+// Backup writes a consistent copy of the store at the last checkpoint
+// into the tar archive, see Snapshot
+func (r *Reader) Backup(w io.Writer) (*BackupManifest, error) {
+	return r.BackupSince(w, nil)
+}
+
+// BackupSince writes an incremental backup that ships the metadata
+// DB, the buffer and the chunks added since the previous backup. The
+// full backup is written if the previous manifest is nil
+func (r *Reader) BackupSince(w io.Writer, prev *BackupManifest) (*BackupManifest, error) {
+
+	tmp, err := ioutil.TempDir("", "cellar-backup")
+	if err != nil {
+		return nil, errors.Wrap(err, "TempDir")
+	}
+	defer os.RemoveAll(tmp)
+
+	var c *capture
+	if c, err = r.capture(tmp, prev); err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	m := c.manifest
+	tw := tar.NewWriter(w)
+	modTime := time.Unix(m.CreatedAt, 0)
+
+	add := func(name string, size int64, src io.Reader) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "WriteHeader %s", name)
+		}
+		if _, err := io.CopyN(tw, src, size); err != nil {
+			return errors.Wrapf(err, "write %s", name)
+		}
+		return nil
+	}
+
+	var manifest []byte
+	if manifest, err = json.Marshal(m); err != nil {
+		return nil, errors.Wrap(err, "json.Marshal")
+	}
+	if err = add(backupManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+
+	var db *os.File
+	if db, err = os.Open(path.Join(tmp, dbFileName)); err != nil {
+		return nil, errors.Wrap(err, "Open")
+	}
+	defer db.Close()
+	var stat os.FileInfo
+	if stat, err = db.Stat(); err != nil {
+		return nil, errors.Wrap(err, "Stat")
+	}
+	if err = add(dbFileName, stat.Size(), db); err != nil {
+		return nil, err
+	}
+
+	files := m.Chunks
+	if m.Buffer != nil {
+		files = append(files[:len(files):len(files)], *m.Buffer)
+	}
+	for _, file := range files {
+		f, found := c.files[file.Name]
+		if !found {
+			// shipped by the previous backup
+			continue
+		}
+		if err = add(file.Name, file.Size, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "tar.Close")
+	}
+	return m, nil
+}
+
+// Restore unpacks the full backup followed by the incremental ones
+// into the empty folder. Backups must form a chain: each incremental
+// backup is based on the previous one. It returns the manifest of the
+// last backup.
+func Restore(dstFolder string, backups ...io.Reader) (*BackupManifest, error) {
+
+	if len(backups) == 0 {
+		return nil, errors.Wrap(ErrInvalidOptions, "no backups to restore")
+	}
+	if err := ensureEmptyFolder(dstFolder); err != nil {
+		return nil, err
+	}
+
+	var m *BackupManifest
+	restored := make(map[string]bool)
+
+	for i, backup := range backups {
+		var err error
+		if m, err = restoreBackup(dstFolder, backup, m, restored); err != nil {
+			return nil, errors.Wrapf(err, "backup %d", i)
+		}
+	}
+
+	// drop the files that were truncated or replaced later
+	keep := map[string]bool{dbFileName: true}
+	for _, chunk := range m.Chunks {
+		keep[chunk.Name] = true
+	}
+	if m.Buffer != nil {
+		keep[m.Buffer.Name] = true
+	}
+	for name := range restored {
+		if keep[name] {
+			continue
+		}
+		if err := os.Remove(path.Join(dstFolder, name)); err != nil {
+			return nil, errors.Wrap(err, "Remove")
+		}
+	}
+
+	for _, chunk := range m.Chunks {
+		stat, err := os.Stat(path.Join(dstFolder, chunk.Name))
+		if err != nil || stat.Size() != chunk.Size {
+			return nil, errors.Wrapf(ErrChunkMissing, "%s is not in the backups", chunk.Name)
+		}
+	}
+	return m, nil
+}
+
+func restoreBackup(folder string, backup io.Reader, prev *BackupManifest, restored map[string]bool) (*BackupManifest, error) {
+
+	tr := tar.NewReader(backup)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "tar.Next")
+	}
+	if hdr.Name != backupManifestName {
+		return nil, errors.Errorf("Expected %s, got %s", backupManifestName, hdr.Name)
+	}
+
+	m := &BackupManifest{}
+	if err = json.NewDecoder(tr).Decode(m); err != nil {
+		return nil, errors.Wrap(err, "Decode manifest")
+	}
+
+	switch {
+	case prev == nil && len(m.Since) > 0:
+		return nil, errors.Wrapf(ErrInvalidOptions, "%s is incremental, restore %s first", m.ID, m.Since)
+	case prev != nil && m.Since != prev.ID:
+		return nil, errors.Wrapf(ErrInvalidOptions, "%s is based on %q instead of %s", m.ID, m.Since, prev.ID)
+	}
+
+	for {
+		if hdr, err = tr.Next(); err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "tar.Next")
+		}
+
+		name := hdr.Name
+		if name != path.Base(name) || name == "." || name == ".." || name == backupManifestName {
+			return nil, errors.Errorf("Unexpected file %q", name)
+		}
+
+		if err = writeFile(path.Join(folder, name), tr); err != nil {
+			return nil, errors.Wrapf(err, "restore %s", name)
+		}
+		restored[name] = true
+	}
+}
+
+func writeFile(loc string, src io.Reader) error {
+	f, err := os.Create(loc)
+	if err != nil {
+		return errors.Wrap(err, "Create")
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, src); err != nil {
+		return errors.Wrap(err, "Copy")
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Wrap(err, "Sync")
+	}
+	return f.Close()
+}
@@ -0,0 +1,162 @@
+package cellar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	end := assertCheckpointPos(t, w)
+
+	// not checkpointed yet, so not in the snapshot
+	_, err = w.Append(genSeedBytes(64, 40))
+	assert(t, err, "Append")
+
+	dst := getFolder()
+	m, err := NewReader(folder, nil).Snapshot(dst)
+	assert(t, err, "Snapshot")
+
+	if m.EndPos != end || len(m.Chunks) == 0 || m.Buffer == nil {
+		t.Fatalf("Unexpected manifest %+v, expected end at %d", m, end)
+	}
+	assertRecords(t, dst, key, 40)
+
+	// snapshot is a store on its own
+	copied, err := NewWriter(dst, 0, key)
+	assert(t, err, "NewWriter snapshot")
+	if copied.VolatilePos() != end {
+		t.Fatalf("Snapshot continues at %d instead of %d", copied.VolatilePos(), end)
+	}
+	_, err = copied.Append(genSeedBytes(64, 40))
+	assert(t, err, "Append snapshot")
+	closeWriter(t, copied)
+	assertRecords(t, dst, key, 41)
+
+	if _, err = NewReader(folder, nil).Snapshot(dst); errors.Cause(err) != ErrInvalidOptions {
+		t.Fatalf("Expected ErrInvalidOptions on non-empty folder, got %v", err)
+	}
+}
+
+func assertCheckpointPos(t *testing.T, w *Writer) int64 {
+	pos, err := w.Checkpoint()
+	assert(t, err, "Checkpoint")
+	return pos
+}
+
+// backupFiles lists the files in the backup archive
+func backupFiles(t *testing.T, backup []byte) []string {
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(backup))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		assert(t, err, "tar.Next")
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err = w.Append(genSeedBytes(64, i))
+			assert(t, err, "Append")
+		}
+		assertCheckpoint(t, w)
+	}
+
+	write(0, 40)
+
+	r := NewReader(folder, nil)
+
+	var full bytes.Buffer
+	base, err := r.Backup(&full)
+	assert(t, err, "Backup")
+	if files := backupFiles(t, full.Bytes()); len(files) != len(base.Chunks)+3 {
+		t.Fatalf("Expected manifest, DB, buffer and %d chunks, got %v", len(base.Chunks), files)
+	}
+
+	write(40, 80)
+
+	// the first chunk is dropped from the store, but not from the backup
+	_, err = w.TruncateBefore(listChunks(t, folder, nil)[1].StartPos)
+	assert(t, err, "TruncateBefore")
+
+	var inc bytes.Buffer
+	m, err := r.BackupSince(&inc, base)
+	assert(t, err, "BackupSince")
+	if m.Since != base.ID {
+		t.Fatalf("Expected backup based on %s, got %s", base.ID, m.Since)
+	}
+
+	shipped := make(map[string]bool)
+	for _, name := range backupFiles(t, inc.Bytes()) {
+		shipped[name] = true
+	}
+	for _, c := range base.Chunks[1:] {
+		if shipped[c.Name] {
+			t.Fatalf("Chunk %s was shipped again", c.Name)
+		}
+	}
+
+	dst := getFolder()
+	restored, err := Restore(dst, bytes.NewReader(full.Bytes()), bytes.NewReader(inc.Bytes()))
+	assert(t, err, "Restore")
+	if restored.ID != m.ID {
+		t.Fatalf("Expected manifest %s, got %s", m.ID, restored.ID)
+	}
+
+	var expected, actual [][]byte
+	collect := func(folder string, out *[][]byte) {
+		err := NewReader(folder, key).Scan(func(info *ReaderInfo, data []byte) error {
+			*out = append(*out, append([]byte{}, data...))
+			return nil
+		})
+		assert(t, err, "Scan")
+	}
+	collect(folder, &expected)
+	collect(dst, &actual)
+	if len(actual) != len(expected) || len(expected) == 0 {
+		t.Fatalf("Restored %d records instead of %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if !bytes.Equal(expected[i], actual[i]) {
+			t.Fatalf("Record %d differs", i)
+		}
+	}
+	if _, err = os.Stat(path.Join(dst, base.Chunks[0].Name)); !os.IsNotExist(err) {
+		t.Fatalf("Expected truncated chunk to be removed, got %v", err)
+	}
+
+	// incremental backup needs its base
+	if _, err = Restore(getFolder(), bytes.NewReader(inc.Bytes())); errors.Cause(err) != ErrInvalidOptions {
+		t.Fatalf("Expected ErrInvalidOptions without the base, got %v", err)
+	}
+}
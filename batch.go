@@ -0,0 +1,169 @@
+package cellar
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// AppendBatch appends the records, framing them in a single pass and
+// writing them to the buffer at once. Batch could span a buffer seal.
+// Returns the position after each record, like Append does. Records
+// before the failed one stay appended, as if Append was called in a loop.
+func (w *Writer) AppendBatch(records [][]byte) ([]int64, error) {
+
+	if err := w.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var err error
+
+	positions := make([]int64, len(records))
+
+	frame := w.batchBuf[:0]
+	var framed int64
+
+	// writes the framed records to the current buffer
+	flush := func() error {
+		if framed == 0 {
+			return nil
+		}
+		if err := w.b.writeBytes(frame); err != nil {
+			return errors.Wrap(err, "write batch")
+		}
+		w.b.endRecords(framed)
+		frame, framed = frame[:0], 0
+		return nil
+	}
+
+	for i, data := range records {
+
+		size := w.framedSize(len(data))
+
+		if !w.b.fits(int64(len(frame) + size)) {
+			if err = flush(); err != nil {
+				return nil, err
+			}
+			if err = w.reserve(size); err != nil {
+				return nil, err
+			}
+		}
+
+		frame = frameRecord(frame, data, w.b.recordChecksums)
+		framed++
+
+		positions[i] = w.b.startPos + w.b.pos + int64(len(frame))
+
+		if dataLen := int64(len(data)); dataLen > w.maxValSize {
+			w.maxValSize = dataLen
+		}
+	}
+
+	if err = flush(); err != nil {
+		return nil, err
+	}
+
+	// large batches don't keep their memory
+	if cap(frame) <= int(w.maxBufferSize) {
+		w.batchBuf = frame
+	}
+	return positions, nil
+}
+
+// framedSize is the number of bytes the record takes in the buffer
+func (w *Writer) framedSize(dataLen int) int {
+	size := varintSize(int64(dataLen)) + dataLen
+	if w.recordChecksums || w.b.recordChecksums {
+		size += recordChecksumSize
+	}
+	return size
+}
+
+// frameRecord appends the record with its length prefix
+// and the optional checksum to the slice
+func frameRecord(dst []byte, data []byte, checksums bool) []byte {
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(header[:], int64(len(data)))
+	dst = append(dst, header[:n]...)
+	dst = append(dst, data...)
+	if checksums {
+		dst = appendRecordChecksum(dst, data)
+	}
+	return dst
+}
+
+// RecordBuilder assembles a record from multiple writes and appends it
+// without concatenating the parts first. Space for the length prefix
+// is reserved in front of the data, so the framed record is written
+// to the buffer in one go. Builder is reused after each Append.
+type RecordBuilder struct {
+	w   *Writer
+	buf []byte
+}
+
+const builderHeader = binary.MaxVarintLen64
+
+// NewRecordBuilder creates a builder that appends to the writer
+func (w *Writer) NewRecordBuilder() *RecordBuilder {
+	return &RecordBuilder{w: w, buf: make([]byte, builderHeader, 1024)}
+}
+
+// Write adds the bytes to the record, it never fails
+func (r *RecordBuilder) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	return len(p), nil
+}
+
+// WriteString adds the string to the record, it never fails
+func (r *RecordBuilder) WriteString(s string) (int, error) {
+	r.buf = append(r.buf, s...)
+	return len(s), nil
+}
+
+// Len returns the size of the record so far
+func (r *RecordBuilder) Len() int {
+	return len(r.buf) - builderHeader
+}
+
+// Reset discards the record
+func (r *RecordBuilder) Reset() {
+	r.buf = r.buf[:builderHeader]
+}
+
+// Append appends the record to the writer and resets the builder.
+// Returns the position after the record, like Writer.Append does
+func (r *RecordBuilder) Append() (int64, error) {
+
+	w := r.w
+	defer r.Reset()
+
+	if err := w.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	data := r.buf[builderHeader:]
+	size := w.framedSize(len(data))
+
+	if err := w.reserve(size); err != nil {
+		return 0, err
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(header[:], int64(len(data)))
+	start := builderHeader - n
+	copy(r.buf[start:], header[:n])
+
+	if w.b.recordChecksums {
+		r.buf = appendRecordChecksum(r.buf, data)
+	}
+
+	if err := w.b.writeBytes(r.buf[start:]); err != nil {
+		return 0, errors.Wrap(err, "write record")
+	}
+	w.b.endRecord()
+
+	if dataLen := int64(len(data)); dataLen > w.maxValSize {
+		w.maxValSize = dataLen
+	}
+	return w.b.startPos + w.b.pos, nil
+}
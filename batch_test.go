@@ -0,0 +1,139 @@
+package cellar
+
+import (
+	"testing"
+)
+
+func batchRecords(count int) [][]byte {
+	var records [][]byte
+	for i := 0; i < count; i++ {
+		records = append(records, genSeedBytes(1+i*7%150, i))
+	}
+	return records
+}
+
+func TestAppendBatch(t *testing.T) {
+	key := genRandBytes(16)
+	records := batchRecords(200)
+
+	// the same records appended one by one
+	loopFolder := getFolder()
+	w, err := NewWriter(loopFolder, 1000, key)
+	assert(t, err, "NewWriter")
+	var expected []int64
+	for i, r := range records {
+		if i == 50 {
+			w.EnableRecordChecksums()
+		}
+		pos, err := w.Append(r)
+		assert(t, err, "Append")
+		expected = append(expected, pos)
+	}
+	assertCheckpoint(t, w)
+	closeWriter(t, w)
+
+	folder := getFolder()
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	// batches span the seals, builder mixes in
+	positions, err := w.AppendBatch(records[:50])
+	assert(t, err, "AppendBatch")
+	w.EnableRecordChecksums()
+
+	rb := w.NewRecordBuilder()
+	for _, r := range records[50:60] {
+		rb.Write(r[:len(r)/2])
+		rb.Write(r[len(r)/2:])
+		if rb.Len() != len(r) {
+			t.Fatalf("Expected builder to have %d bytes but got %d", len(r), rb.Len())
+		}
+		pos, err := rb.Append()
+		assert(t, err, "RecordBuilder.Append")
+		positions = append(positions, pos)
+	}
+
+	rest, err := w.AppendBatch(records[60:])
+	assert(t, err, "AppendBatch")
+	positions = append(positions, rest...)
+	assertCheckpoint(t, w)
+
+	for i := range expected {
+		if positions[i] != expected[i] {
+			t.Fatalf("Expected record %d to end at %d but got %d", i, expected[i], positions[i])
+		}
+	}
+
+	expectedInfos := scanInfos(t, NewReader(loopFolder, key))
+	infos := scanInfos(t, NewReader(folder, key))
+	if len(infos) != len(expectedInfos) {
+		t.Fatalf("Expected %d records but got %d", len(expectedInfos), len(infos))
+	}
+	for i := range infos {
+		if infos[i] != expectedInfos[i] {
+			t.Fatalf("Expected %v but got %v", expectedInfos[i], infos[i])
+		}
+	}
+}
+
+func benchmarkAppend(b *testing.B, appendBatch func(w *Writer, records [][]byte) error) {
+	folder := getFolder()
+	w, err := NewWriter(folder, 4*1024*1024, genRandBytes(16))
+	if err != nil {
+		b.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	records := make([][]byte, 1000)
+	for i := range records {
+		records[i] = genSeedBytes(64, i)
+	}
+
+	b.SetBytes(int64(len(records) * 64))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err = appendBatch(w, records); err != nil {
+			b.Fatalf("Append: %s", err)
+		}
+	}
+	b.StopTimer()
+
+	if _, err = w.Checkpoint(); err != nil {
+		b.Fatalf("Checkpoint: %s", err)
+	}
+}
+
+func BenchmarkAppendLoop(b *testing.B) {
+	benchmarkAppend(b, func(w *Writer, records [][]byte) error {
+		for _, r := range records {
+			if _, err := w.Append(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkAppendBatch(b *testing.B) {
+	benchmarkAppend(b, func(w *Writer, records [][]byte) error {
+		_, err := w.AppendBatch(records)
+		return err
+	})
+}
+
+func BenchmarkRecordBuilder(b *testing.B) {
+	benchmarkAppend(b, func(w *Writer, records [][]byte) error {
+		rb := w.NewRecordBuilder()
+		for _, r := range records {
+			rb.Write(r[:32])
+			rb.Write(r[32:])
+			if _, err := rb.Append(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
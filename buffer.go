@@ -2,13 +2,12 @@ package cellar
 
 import (
 	"bufio"
-	"crypto/cipher"
+	"hash/crc32"
 	"io"
-	"log"
 	"os"
 	"path"
+	"time"
 
-	"github.com/pierrec/lz4"
 	"github.com/pkg/errors"
 )
 
@@ -20,6 +19,9 @@ type Buffer struct {
 	records int64
 	pos     int64
 
+	// records are followed by their CRC-32C
+	recordChecksums bool
+
 	writer *bufio.Writer
 	stream *os.File
 }
@@ -49,6 +51,8 @@ func openBuffer(d *BufferDto, folder string) (*Buffer, error) {
 		records:  d.Records,
 		stream:   f,
 		writer:   bufio.NewWriter(f),
+
+		recordChecksums: d.RecordChecksums,
 	}
 	return b, nil
 }
@@ -60,6 +64,8 @@ func (b *Buffer) getState() *BufferDto {
 		StartPos: b.startPos,
 		Pos:      b.pos,
 		Records:  b.records,
+
+		RecordChecksums: b.recordChecksums,
 	}
 }
 
@@ -67,6 +73,13 @@ func (b *Buffer) fits(bytes int64) bool {
 	return (b.pos + bytes) <= b.maxBytes
 }
 
+// grow lets the buffer fit the bytes past its max size
+func (b *Buffer) grow(bytes int64) {
+	if b.pos+bytes > b.maxBytes {
+		b.maxBytes = b.pos + bytes
+	}
+}
+
 func (b *Buffer) writeBytes(bs []byte) error {
 	if _, err := b.writer.Write(bs); err != nil {
 		return errors.Wrap(err, "Write")
@@ -79,6 +92,33 @@ func (b *Buffer) endRecord() {
 	b.records++
 }
 
+func (b *Buffer) endRecords(n int64) {
+	b.records += n
+}
+
+// rollback discards everything past the saved state, both
+// in memory and on disk
+func (b *Buffer) rollback(d *BufferDto) error {
+
+	b.writer.Reset(b.stream)
+
+	// zeroes past the position, as in a fresh buffer
+	if err := b.stream.Truncate(d.Pos); err != nil {
+		return errors.Wrap(err, "Truncate")
+	}
+	if err := b.stream.Truncate(d.MaxBytes); err != nil {
+		return errors.Wrap(err, "Truncate")
+	}
+	if _, err := b.stream.Seek(d.Pos, io.SeekStart); err != nil {
+		return errors.Wrap(err, "Seek")
+	}
+
+	b.pos = d.Pos
+	b.records = d.Records
+	b.maxBytes = d.MaxBytes
+	return nil
+}
+
 func (b *Buffer) flush() error {
 	if err := b.writer.Flush(); err != nil {
 		return errors.Wrap(err, "Flush")
@@ -98,19 +138,20 @@ func (b *Buffer) close() error {
 	return nil
 }
 
-func (b *Buffer) compress(key []byte) (dto *ChunkDto, err error) {
+func (b *Buffer) compress(key []byte, codec Codec, level int) (dto *ChunkDto, err error) {
 
-	loc := b.stream.Name() + ".lz4"
+	name := b.fileName + "." + codec.Name()
+	loc := b.stream.Name() + "." + codec.Name()
 
 	if err = b.writer.Flush(); err != nil {
-		log.Panicf("Failed to flush buffer: %s", err)
+		return nil, errors.Wrap(err, "Flush")
 	}
 	if err = b.stream.Sync(); err != nil {
-		log.Panicf("Failed to Fsync buffer: %s", err)
+		return nil, errors.Wrap(err, "Sync")
 	}
 
 	if _, err = b.stream.Seek(0, io.SeekStart); err != nil {
-		log.Panicf("Failed to seek to 0 in buffer: %s", err)
+		return nil, errors.Wrap(err, "Seek")
 	}
 
 	// create chunk file
@@ -119,55 +160,68 @@ func (b *Buffer) compress(key []byte) (dto *ChunkDto, err error) {
 		return nil, errors.Wrap(err, "os.Create")
 	}
 
-	defer func() {
-		if err := chunkFile.Sync(); err != nil {
-			panic("Failed to sync")
-		}
-		if err := chunkFile.Close(); err != nil {
-			panic("Failed to close")
-		}
-	}()
+	// no-op if the chunk is completed
+	defer chunkFile.Close()
 
 	// buffer writes to file
 	buffer := bufio.NewWriter(chunkFile)
 
-	defer buffer.Flush()
-
 	// encrypt before buffering
-	var encryptor *cipher.StreamWriter
-	if encryptor, err = chainEncryptor(key, buffer); err != nil {
-		log.Panicf("Failed to chain encryptor for %s: %s", loc, err)
+	var encryptor io.WriteCloser
+	if encryptor, err = chainSealer(key, b.startPos, buffer); err != nil {
+		return nil, errors.Wrapf(err, "chainSealer for %s", loc)
 	}
 
-	defer encryptor.Close()
-
 	// compress before encrypting
 
-	var zw *lz4.Writer
-	if zw, err = chainCompressor(encryptor); err != nil {
-		log.Panicf("Failed to chain compressor: %s", err)
+	var zw io.WriteCloser
+	if zw, err = codec.NewWriter(encryptor, level); err != nil {
+		return nil, errors.Wrapf(err, "%s.NewWriter", codec.Name())
 	}
 
-	// copy chunk to the chain
-	if _, err = io.CopyN(zw, b.stream, b.pos); err != nil {
+	// copy chunk to the chain, computing the checksum on the way
+	crc := crc32.New(crcTable)
+	if _, err = io.CopyN(zw, io.TeeReader(b.stream, crc), b.pos); err != nil {
 		return nil, errors.Wrap(err, "CopyN")
 	}
 
-	zw.Close()
-	chunkFile.Sync()
-	b.close()
+	// flush the chain from the top
+	if err = zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "zw.Close")
+	}
+	if err = encryptor.Close(); err != nil {
+		return nil, errors.Wrap(err, "encryptor.Close")
+	}
+	if err = buffer.Flush(); err != nil {
+		return nil, errors.Wrap(err, "buffer.Flush")
+	}
+	if err = chunkFile.Sync(); err != nil {
+		return nil, errors.Wrap(err, "chunkFile.Sync")
+	}
 
 	var size int64
 	if size, err = chunkFile.Seek(0, io.SeekEnd); err != nil {
 		return nil, errors.Wrap(err, "Seek")
 	}
+	if err = chunkFile.Close(); err != nil {
+		return nil, errors.Wrap(err, "chunkFile.Close")
+	}
+	if err = b.close(); err != nil {
+		return nil, errors.Wrap(err, "close")
+	}
 
 	dto = &ChunkDto{
-		FileName:             b.fileName + ".lz4",
+		FileName:             name,
 		Records:              b.records,
 		UncompressedByteSize: b.pos,
 		StartPos:             b.startPos,
 		CompressedDiskSize:   size,
+		Checksum:             crc.Sum32(),
+		HasChecksum:          true,
+		RecordChecksums:      b.recordChecksums,
+		FormatVersion:        chunkFormatGCM,
+		Codec:                codec.ID(),
+		SealedAt:             time.Now().Unix(),
 	}
 	return dto, nil
 }
@@ -76,7 +76,7 @@ func TestExist(t *testing.T) {
 
 	key := []byte("example key 1234")
 	var chunk *ChunkDto
-	chunk, err = buf.compress(key)
+	chunk, err = buf.compress(key, CodecLZ4, DefaultLevel)
 
 	assert(t, err, "compress")
 	assertExists(t, path.Join(folder, chunk.FileName))
@@ -4,44 +4,53 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"io"
-	"log"
 
-	"github.com/pierrec/lz4"
 	"github.com/pkg/errors"
 )
 
 var compressionLevel = 10
 
 // SetCompressionLevel allows you to set LZ4 compression level used for chunks
+// written with the DefaultLevel.
+//
+// Deprecated: the setting is shared by all writers, use Options.Level instead.
 func SetCompressionLevel(level int) {
 	compressionLevel = level
 }
 
-func chainCompressor(w io.Writer) (*lz4.Writer, error) {
-	zw := lz4.NewWriter(w)
-	zw.Header.CompressionLevel = compressionLevel
-	return zw, nil
+// checkKey makes sure the key could be used for AES-128, AES-192 or AES-256
+func checkKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return errors.Wrapf(ErrBadKey, "key has %d bytes", len(key))
 }
 
-func chainDecompressor(r io.Reader) (io.Reader, error) {
-	zr := lz4.NewReader(r)
-	return zr, nil
-}
+// Formats of the chunk encryption
+const (
+	// AES-CFB without authentication, written by the early versions
+	chunkFormatCFB int32 = 0
+	// AES-GCM over the framed segments
+	chunkFormatGCM int32 = 1
+)
 
+// chainDecryptor reads chunks in the legacy CFB format
 func chainDecryptor(key []byte, src io.Reader) (io.Reader, error) {
 	var (
 		block cipher.Block
 		err   error
 	)
 	if block, err = aes.NewCipher(key); err != nil {
-		log.Panic("Failed to create a new cipher from the key")
+		return nil, errors.Wrap(ErrBadKey, err.Error())
 	}
 
 	iv := make([]byte, aes.BlockSize)
 
-	if _, err = src.Read(iv); err != nil {
-		return nil, errors.Wrap(err, "Failed to read IV")
+	if _, err = io.ReadFull(src, iv); err != nil {
+		return nil, errors.Wrap(ErrShortRead, "Failed to read IV")
 	}
 
 	stream := cipher.NewCFBDecrypter(block, iv)
@@ -49,26 +58,68 @@ func chainDecryptor(key []byte, src io.Reader) (io.Reader, error) {
 	return reader, nil
 }
 
-func chainEncryptor(key []byte, w io.Writer) (*cipher.StreamWriter, error) {
+// chunkAD binds the chunk to its start position, so that
+// authenticated chunks can't be swapped on disk
+func chunkAD(startPos int64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(startPos))
+	return ad
+}
 
+func newGCM(key []byte) (cipher.AEAD, error) {
 	var (
 		block cipher.Block
 		err   error
 	)
 	if block, err = aes.NewCipher(key); err != nil {
-		log.Panic("Failed to create a new cipher from the key")
+		return nil, errors.Wrap(ErrBadKey, err.Error())
 	}
+	return cipher.NewGCM(block)
+}
 
-	iv := make([]byte, aes.BlockSize)
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		panic(err)
+// chainSealer encrypts and authenticates the chunk that starts
+// at the given position
+func chainSealer(key []byte, startPos int64, w io.Writer) (io.WriteCloser, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err = io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, errors.Wrap(err, "Failed to generate nonce")
 	}
 
-	if _, err = w.Write(iv); err != nil {
+	if _, err = w.Write(prefix); err != nil {
 		return nil, errors.Wrap(err, "Write")
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
+	return newSegmentWriter(aead, w, prefix, chunkAD(startPos)), nil
+}
+
+// chainOpener decrypts the chunk written by chainSealer, failing
+// with ErrAuthFailed if it was tampered with or truncated
+func chainOpener(key []byte, startPos int64, src io.Reader) (io.Reader, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
 
-	writer := &cipher.StreamWriter{S: stream, W: w}
-	return writer, nil
+	prefix := make([]byte, noncePrefixSize)
+	if _, err = io.ReadFull(src, prefix); err != nil {
+		return nil, errors.Wrap(ErrAuthFailed, "Failed to read nonce")
+	}
+	return newSegmentReader(aead, src, prefix, chunkAD(startPos)), nil
+}
+
+// chainChunkDecryptor picks the decryptor matching the chunk format
+func chainChunkDecryptor(key []byte, c *ChunkDto, src io.Reader) (io.Reader, error) {
+	switch c.FormatVersion {
+	case chunkFormatCFB:
+		return chainDecryptor(key, src)
+	case chunkFormatGCM:
+		return chainOpener(key, c.StartPos, src)
+	}
+	return nil, errors.Wrapf(ErrCorruptChunk, "unknown format version %d", c.FormatVersion)
 }
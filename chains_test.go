@@ -0,0 +1,160 @@
+package cellar
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// chainEncryptor writes chunks in the legacy CFB format
+func chainEncryptor(key []byte, w io.Writer) (*cipher.StreamWriter, error) {
+
+	var (
+		block cipher.Block
+		err   error
+	)
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, errors.Wrap(ErrBadKey, err.Error())
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, errors.Wrap(err, "Failed to generate IV")
+	}
+
+	if _, err = w.Write(iv); err != nil {
+		return nil, errors.Wrap(err, "Write")
+	}
+	stream := cipher.NewCFBEncrypter(block, iv)
+
+	writer := &cipher.StreamWriter{S: stream, W: w}
+	return writer, nil
+}
+
+func sealSegments(t *testing.T, key []byte, startPos int64, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := chainSealer(key, startPos, &buf)
+	assert(t, err, "chainSealer")
+	_, err = w.Write(data)
+	assert(t, err, "Write")
+	assert(t, w.Close(), "Close")
+	return buf.Bytes()
+}
+
+func openSegments(key []byte, startPos int64, sealed []byte) ([]byte, error) {
+	r, err := chainOpener(key, startPos, bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestSegmentsRoundTrip(t *testing.T) {
+	key := genRandBytes(32)
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 17} {
+		data := genSeedBytes(size, size)
+		sealed := sealSegments(t, key, 42, data)
+
+		opened, err := openSegments(key, 42, sealed)
+		assert(t, err, "openSegments")
+		if !bytes.Equal(data, opened) {
+			t.Fatalf("Round trip of %d bytes returned %d bytes", size, len(opened))
+		}
+	}
+}
+
+func TestSegmentsTampering(t *testing.T) {
+	key := genRandBytes(16)
+	data := genSeedBytes(2*segmentSize+100, 1)
+	sealed := sealSegments(t, key, 0, data)
+
+	flipped := append([]byte{}, sealed...)
+	flipped[segmentSize+100] ^= 1
+
+	// drop the last segment, leaving valid complete segments
+	lastSize := 4 + 100 + 16
+	truncated := sealed[:len(sealed)-lastSize]
+
+	cases := map[string][]byte{
+		"flipped":   flipped,
+		"truncated": truncated,
+		"cut":       sealed[:len(sealed)-1],
+		"appended":  append(append([]byte{}, sealed...), 0),
+	}
+
+	for name, c := range cases {
+		if _, err := openSegments(key, 0, c); errors.Cause(err) != ErrAuthFailed {
+			t.Fatalf("%s: expected ErrAuthFailed but got %v", name, err)
+		}
+	}
+
+	// chunks can't be moved to another position
+	if _, err := openSegments(key, 1, sealed); errors.Cause(err) != ErrAuthFailed {
+		t.Fatalf("Expected ErrAuthFailed for a moved chunk but got %v", err)
+	}
+}
+
+// rewriteLegacy replaces the chunk with its version in the CFB format
+func rewriteLegacy(t *testing.T, folder string, key []byte, c *ChunkDto) {
+	loc := path.Join(folder, c.FileName)
+
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+
+	data := make([]byte, c.UncompressedByteSize)
+	data, err = loadChunkIntoBuffer(loc, keys, c, data)
+	assert(t, err, "loadChunkIntoBuffer")
+
+	f, err := os.Create(loc)
+	assert(t, err, "Create")
+	encryptor, err := chainEncryptor(key, f)
+	assert(t, err, "chainEncryptor")
+	zw, err := CodecLZ4.NewWriter(encryptor, DefaultLevel)
+	assert(t, err, "NewWriter")
+	_, err = zw.Write(data)
+	assert(t, err, "Write")
+	assert(t, zw.Close(), "zw.Close")
+	assert(t, f.Close(), "Close")
+
+	c.FormatVersion = chunkFormatCFB
+}
+
+func TestLegacyChunksAreReadable(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	db, err := mdb.New(folder, mdb.NewConfig())
+	assert(t, err, "mdb.New")
+
+	err = db.Update(func(tx *mdb.Tx) error {
+		for _, c := range chunks {
+			rewriteLegacy(t, folder, key, c)
+			if err := tx.PutProto(mdb.CreateKey(ChunkTable, c.StartPos), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert(t, err, "Update")
+	db.Close()
+
+	assertRecords(t, folder, key, 40)
+
+	// legacy chunks can't detect tampering, but still fail cleanly
+	loc := path.Join(folder, chunks[0].FileName)
+	assert(t, os.Truncate(loc, 20), "Truncate")
+	reader := NewReader(folder, key)
+	err = reader.Scan(func(pos *ReaderInfo, s []byte) error { return nil })
+	if cause := errors.Cause(err); cause != ErrCorruptChunk && cause != ErrShortRead {
+		t.Fatalf("Expected corrupt chunk but got %v", err)
+	}
+}
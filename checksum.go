@@ -0,0 +1,42 @@
+package cellar
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+// recordChecksumSize is the size of the CRC-32C that follows each record
+// when record checksums are enabled
+const recordChecksumSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func putRecordChecksum(buf []byte, record []byte) []byte {
+	binary.LittleEndian.PutUint32(buf, crc32.Checksum(record, crcTable))
+	return buf[0:recordChecksumSize]
+}
+
+func appendRecordChecksum(dst []byte, record []byte) []byte {
+	var buf [recordChecksumSize]byte
+	return append(dst, putRecordChecksum(buf[:], record)...)
+}
+
+func checkRecordChecksum(record []byte, sum []byte) error {
+	expected := binary.LittleEndian.Uint32(sum)
+	if actual := crc32.Checksum(record, crcTable); actual != expected {
+		return errors.Wrapf(ErrChecksumMismatch, "record has %08x instead of %08x", actual, expected)
+	}
+	return nil
+}
+
+func checkChunkChecksum(c *ChunkDto, data []byte) error {
+	if !c.HasChecksum {
+		return nil
+	}
+	if actual := crc32.Checksum(data, crcTable); actual != c.Checksum {
+		return errors.Wrapf(ErrChecksumMismatch, "chunk %s has %08x instead of %08x", c.FileName, actual, c.Checksum)
+	}
+	return nil
+}
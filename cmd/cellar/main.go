@@ -0,0 +1,614 @@
+// Command cellar inspects and operates on the cellar stores
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abdullin/cellar"
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage: cellar <command> [flags] <folder>
+
+Commands:
+  info         chunks, buffer and sizes of the store
+  scan, cat    print the records
+  checkpoints  list or set the user checkpoints
+  verify       check the chunks and the buffer for damage
+  export       write the records as binary, ndjson, csv or tsv
+  import       append the records exported as binary or ndjson
+
+Commands that read or write the records need the key. It is
+taken from -key (hex), -key-file (hex or raw bytes) or the
+CELLAR_KEY environment variable (hex), in this order.
+
+Run 'cellar <command> -h' for the flags of the command.
+`
+
+// keyEnv is the environment variable with the hex key
+const keyEnv = "CELLAR_KEY"
+
+// defaultImportBuffer is the buffer size of the stores created by import
+const defaultImportBuffer = 64 * 1024 * 1024
+
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailed  = 1
+	exitUsage   = 2
+	exitDamaged = 3
+)
+
+var (
+	errUsage   = errors.New("usage")
+	errDamaged = errors.New("store is damaged")
+)
+
+type command func(args []string, stdout io.Writer) error
+
+var commands = map[string]command{
+	"info":        runInfo,
+	"scan":        runScan,
+	"cat":         runCat,
+	"checkpoints": runCheckpoints,
+	"verify":      runVerify,
+	"export":      runExport,
+	"import":      runImport,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	cmd, found := commands[args[0]]
+	if !found {
+		if args[0] == "-h" || args[0] == "help" {
+			fmt.Fprint(stdout, usage)
+			return exitOK
+		}
+		fmt.Fprintf(stderr, "cellar: unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	err := cmd(args[1:], stdout)
+	switch errors.Cause(err) {
+	case nil, flag.ErrHelp:
+		return exitOK
+	case errUsage:
+		fmt.Fprintf(stderr, "cellar %s: %s\n", args[0], err)
+		return exitUsage
+	case errDamaged:
+		fmt.Fprintf(stderr, "cellar %s: %s\n", args[0], err)
+		return exitDamaged
+	}
+	fmt.Fprintf(stderr, "cellar %s: %s\n", args[0], err)
+	return exitFailed
+}
+
+// keyFlags resolve the key from the flags, the file or the environment
+type keyFlags struct {
+	hex  string
+	file string
+}
+
+func (k *keyFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&k.hex, "key", "", "encryption key in hex")
+	fs.StringVar(&k.file, "key-file", "", "file with the encryption key, hex or raw bytes")
+}
+
+func (k *keyFlags) load() ([]byte, error) {
+
+	if len(k.hex) > 0 {
+		key, err := hex.DecodeString(k.hex)
+		if err != nil {
+			return nil, errors.Wrap(errUsage, "-key is not hex")
+		}
+		return key, nil
+	}
+
+	if len(k.file) > 0 {
+		data, err := ioutil.ReadFile(k.file)
+		if err != nil {
+			return nil, errors.Wrap(err, "ReadFile")
+		}
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			return key, nil
+		}
+		return data, nil
+	}
+
+	if env := os.Getenv(keyEnv); len(env) > 0 {
+		key, err := hex.DecodeString(strings.TrimSpace(env))
+		if err != nil {
+			return nil, errors.Wrapf(errUsage, "%s is not hex", keyEnv)
+		}
+		return key, nil
+	}
+	return nil, errors.Wrapf(errUsage, "key is required: -key, -key-file or %s", keyEnv)
+}
+
+// parse parses the flags, returning the folder that follows them
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", errors.Wrap(errUsage, "expected a single folder after the flags")
+	}
+	return fs.Arg(0), nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("cellar "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cellar %s [flags] <folder>\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// checkStore makes sure that the folder holds a store, readers
+// would create an empty metadata DB otherwise
+func checkStore(folder string) error {
+	if _, err := os.Stat(filepath.Join(folder, "data.mdb")); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("%s is not a cellar store", folder)
+		}
+		return errors.Wrap(err, "Stat")
+	}
+	return nil
+}
+
+func loadInfo(folder string) (*cellar.StoreInfo, error) {
+	if err := checkStore(folder); err != nil {
+		return nil, err
+	}
+	info, err := cellar.NewReader(folder, nil).Info()
+	if err != nil {
+		return nil, errors.Wrap(err, "Info")
+	}
+	return info, nil
+}
+
+func runInfo(args []string, stdout io.Writer) error {
+
+	fs := newFlagSet("info")
+	chunks := fs.Bool("chunks", false, "list the chunks")
+	folder, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	info, err := loadInfo(folder)
+	if err != nil {
+		return err
+	}
+
+	var records, size, disk int64
+	for _, c := range info.Chunks {
+		records += c.Records
+		size += c.UncompressedByteSize
+		disk += c.CompressedDiskSize
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "folder:\t%s\n", folder)
+	if info.Meta != nil {
+		fmt.Fprintf(tw, "buffer size:\t%d\n", info.Meta.BufferSize)
+		fmt.Fprintf(tw, "codec:\t%s\n", codecName(info.Meta.Codec))
+		fmt.Fprintf(tw, "record checksums:\t%t\n", info.Meta.RecordChecksums)
+		fmt.Fprintf(tw, "current key:\t%d\n", info.Meta.KeyId)
+		fmt.Fprintf(tw, "low-water mark:\t%d\n", info.Meta.LowWaterMark)
+	}
+	fmt.Fprintf(tw, "chunks:\t%d\n", len(info.Chunks))
+	fmt.Fprintf(tw, "chunk records:\t%d\n", records)
+	fmt.Fprintf(tw, "chunk bytes:\t%d\n", size)
+	fmt.Fprintf(tw, "chunk disk bytes:\t%d\n", disk)
+	fmt.Fprintf(tw, "compression ratio:\t%s\n", ratio(size, disk))
+
+	if b := info.Buffer; b != nil {
+		fmt.Fprintf(tw, "buffer:\t%s\n", b.FileName)
+		fmt.Fprintf(tw, "buffer records:\t%d\n", b.Records)
+		fmt.Fprintf(tw, "buffer bytes:\t%d of %d\n", b.Pos, b.MaxBytes)
+		records += b.Records
+		size += b.Pos
+		fmt.Fprintf(tw, "end position:\t%d\n", b.StartPos+b.Pos)
+	}
+	fmt.Fprintf(tw, "total records:\t%d\n", records)
+	fmt.Fprintf(tw, "total bytes:\t%d\n", size)
+	fmt.Fprintf(tw, "user checkpoints:\t%d\n", len(info.Checkpoints))
+
+	if *chunks && len(info.Chunks) > 0 {
+		fmt.Fprintf(tw, "\nfile\tstart\trecords\tbytes\tdisk\tratio\tcodec\tkey\tsealed\n")
+		for _, c := range info.Chunks {
+			sealed := "-"
+			if c.SealedAt > 0 {
+				sealed = time.Unix(c.SealedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%d\t%s\n",
+				c.FileName, c.StartPos, c.Records, c.UncompressedByteSize,
+				c.CompressedDiskSize, ratio(c.UncompressedByteSize, c.CompressedDiskSize),
+				codecName(c.Codec), c.KeyId, sealed)
+		}
+	}
+	return tw.Flush()
+}
+
+func codecName(id uint32) string {
+	codec, err := cellar.CodecByID(id)
+	if err != nil {
+		return fmt.Sprintf("unknown(%d)", id)
+	}
+	return codec.Name()
+}
+
+func ratio(size, disk int64) string {
+	if disk == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(size)/float64(disk), 'f', 2, 64)
+}
+
+// Output formats of the records
+const (
+	formatRaw    = "raw"
+	formatHex    = "hex"
+	formatBase64 = "base64"
+	// formatLen prefixes each record with its length as uvarint,
+	// this is cellar.FormatBinary
+	formatLen = "len"
+)
+
+func runScan(args []string, stdout io.Writer) error {
+	return scan("scan", formatHex, args, stdout)
+}
+
+func runCat(args []string, stdout io.Writer) error {
+	return scan("cat", formatRaw, args, stdout)
+}
+
+func scan(name, format string, args []string, stdout io.Writer) error {
+
+	var keys keyFlags
+
+	fs := newFlagSet(name)
+	keys.register(fs)
+	start := fs.Int64("start", 0, "position of the first record")
+	end := fs.Int64("end", 0, "position to stop before, 0 reads till the end")
+	fs.StringVar(&format, "format", format, "output format: raw, hex, base64 or len")
+	pos := fs.Bool("pos", false, "prefix the hex and base64 lines with the record position")
+
+	folder, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var encode func(w *bufio.Writer, pos int64, data []byte) error
+
+	switch format {
+	case formatRaw, formatLen:
+		if *pos {
+			return errors.Wrapf(errUsage, "-pos doesn't work with %s format", format)
+		}
+		encode = func(w *bufio.Writer, pos int64, data []byte) error {
+			_, err := w.Write(data)
+			return err
+		}
+	case formatHex:
+		encode = lineWriter(hex.EncodeToString, *pos)
+	case formatBase64:
+		encode = lineWriter(base64.StdEncoding.EncodeToString, *pos)
+	default:
+		return errors.Wrapf(errUsage, "unknown format %q", format)
+	}
+
+	key, err := keys.load()
+	if err != nil {
+		return err
+	}
+
+	// length-prefixed records are the binary export as is
+	if format == formatLen {
+		_, err = exportRange(folder, key, *start, *end, cellar.FormatBinary, stdout)
+		return err
+	}
+
+	r, err := rangeReader(folder, key, *start, *end)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(stdout)
+	err = r.ScanRange(func(info *cellar.ReaderInfo, data []byte) error {
+		if err := encode(out, info.StartPos, data); err != nil {
+			return errors.Wrap(err, "Write")
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "ScanRange")
+	}
+	return out.Flush()
+}
+
+func lineWriter(encode func([]byte) string, withPos bool) func(w *bufio.Writer, pos int64, data []byte) error {
+	return func(w *bufio.Writer, pos int64, data []byte) error {
+		if withPos {
+			w.WriteString(strconv.FormatInt(pos, 10))
+			w.WriteByte('\t')
+		}
+		w.WriteString(encode(data))
+		return w.WriteByte('\n')
+	}
+}
+
+// rangeReader reads the records that start within [start, end)
+func rangeReader(folder string, key []byte, start, end int64) (*cellar.Reader, error) {
+
+	if err := checkStore(folder); err != nil {
+		return nil, err
+	}
+
+	r := cellar.NewReader(folder, key)
+	r.StartPos = start
+	r.EndPos = end
+	return r, nil
+}
+
+// exportRange exports the records that start within [start, end)
+func exportRange(folder string, key []byte, start, end int64, format cellar.Format, w io.Writer) (int64, error) {
+
+	r, err := rangeReader(folder, key, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := cellar.Export(r, w, format)
+	if err != nil {
+		return count, errors.Wrap(err, "Export")
+	}
+	return count, nil
+}
+
+func runCheckpoints(args []string, stdout io.Writer) error {
+
+	var keys keyFlags
+
+	fs := newFlagSet("checkpoints")
+	keys.register(fs)
+	set := fs.String("set", "", "save the checkpoint given as name=pos, needs the key")
+
+	folder, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(*set) > 0 {
+		eq := strings.LastIndexByte(*set, '=')
+		if eq <= 0 {
+			return errors.Wrapf(errUsage, "expected name=pos, got %q", *set)
+		}
+		pos, err := strconv.ParseInt((*set)[eq+1:], 10, 64)
+		if err != nil {
+			return errors.Wrapf(errUsage, "bad position in %q", *set)
+		}
+		key, err := keys.load()
+		if err != nil {
+			return err
+		}
+		if err = checkStore(folder); err != nil {
+			return err
+		}
+		return setCheckpoint(folder, key, (*set)[:eq], pos)
+	}
+
+	info, err := loadInfo(folder)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range info.Checkpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%d\n", name, info.Checkpoints[name])
+	}
+	return tw.Flush()
+}
+
+func setCheckpoint(folder string, key []byte, name string, pos int64) error {
+	w, err := cellar.NewWriter(folder, 0, key)
+	if err != nil {
+		return errors.Wrap(err, "NewWriter")
+	}
+	if err = w.PutUserCheckpoint(name, pos); err != nil {
+		w.CloseWithoutCheckpoint()
+		return errors.Wrap(err, "PutUserCheckpoint")
+	}
+	return w.Close()
+}
+
+func runVerify(args []string, stdout io.Writer) error {
+
+	var keys keyFlags
+
+	fs := newFlagSet("verify")
+	keys.register(fs)
+
+	folder, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	key, err := keys.load()
+	if err != nil {
+		return err
+	}
+	if err = checkStore(folder); err != nil {
+		return err
+	}
+
+	report, err := cellar.Verify(folder, key)
+	if err != nil {
+		return errors.Wrap(err, "Verify")
+	}
+
+	fmt.Fprintf(stdout, "verified %d chunks, %d records, %d bytes\n", report.Chunks, report.Records, report.Bytes)
+	for _, d := range report.Damaged {
+		fmt.Fprintf(stdout, "damaged %s [%d, %d): %s\n", d.File, d.StartPos, d.EndPos, d.Reason)
+	}
+	if !report.OK() {
+		return errors.Wrapf(errDamaged, "%d damaged ranges", len(report.Damaged))
+	}
+	return nil
+}
+
+// parseFormat resolves the format of export and import
+func parseFormat(name string) (cellar.Format, error) {
+	format, err := cellar.ParseFormat(name)
+	if err != nil {
+		return format, errors.Wrapf(errUsage, "unknown format %q", name)
+	}
+	return format, nil
+}
+
+func runExport(args []string, stdout io.Writer) error {
+
+	var keys keyFlags
+
+	fs := newFlagSet("export")
+	keys.register(fs)
+	start := fs.Int64("start", 0, "position of the first record")
+	end := fs.Int64("end", 0, "position to stop before, 0 exports till the end")
+	output := fs.String("o", "", "output file, stdout if empty")
+	formatName := fs.String("format", "binary", "binary, ndjson, csv or tsv")
+
+	folder, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	format, err := parseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	key, err := keys.load()
+	if err != nil {
+		return err
+	}
+	// before the output file is created
+	if err = checkStore(folder); err != nil {
+		return err
+	}
+
+	dst := stdout
+	var file *os.File
+	if len(*output) > 0 {
+		if file, err = os.Create(*output); err != nil {
+			return errors.Wrap(err, "os.Create")
+		}
+		defer file.Close()
+		dst = file
+	}
+
+	count, err := exportRange(folder, key, *start, *end, format, dst)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		if err = file.Close(); err != nil {
+			return errors.Wrap(err, "Close")
+		}
+		fmt.Fprintf(stdout, "exported %d records\n", count)
+	}
+	return nil
+}
+
+func runImport(args []string, stdout io.Writer) error {
+
+	var keys keyFlags
+
+	fs := newFlagSet("import")
+	keys.register(fs)
+	input := fs.String("i", "", "input file, stdin if empty")
+	bufferSize := fs.Int64("buffer", 0, "buffer size of a new store, 64MB if 0")
+	formatName := fs.String("format", "binary", "binary or ndjson")
+	index := fs.String("index", "", "index the source positions under this stream, ndjson only")
+	keep := fs.Bool("keep-positions", false, "fail if a record doesn't land at its source position, ndjson only")
+
+	folder, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	format, err := parseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	// checked before the store is created
+	switch {
+	case format == cellar.FormatCSV || format == cellar.FormatTSV:
+		return errors.Wrapf(errUsage, "%s has no payloads to import", format)
+	case format == cellar.FormatBinary && (len(*index) > 0 || *keep):
+		return errors.Wrap(errUsage, "binary format has no positions")
+	}
+	key, err := keys.load()
+	if err != nil {
+		return err
+	}
+
+	var src io.Reader = os.Stdin
+	if len(*input) > 0 {
+		file, err := os.Open(*input)
+		if err != nil {
+			return errors.Wrap(err, "os.Open")
+		}
+		defer file.Close()
+		src = file
+	}
+
+	// existing stores keep their buffer size
+	if *bufferSize == 0 && checkStore(folder) != nil {
+		*bufferSize = defaultImportBuffer
+	}
+
+	w, err := cellar.NewWriter(folder, *bufferSize, key)
+	if err != nil {
+		return errors.Wrap(err, "NewWriter")
+	}
+
+	imp := &cellar.Importer{Dst: w, Format: format, PositionIndex: *index, KeepPositions: *keep}
+	count, err := imp.Run(src)
+	if err != nil {
+		// drop the records after the last seal of the buffer
+		w.CloseWithoutCheckpoint()
+		return errors.Wrap(err, "Import")
+	}
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "Close")
+	}
+	fmt.Fprintf(stdout, "imported %d records\n", count)
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abdullin/cellar"
+)
+
+func TestMain(m *testing.M) {
+	retCode := m.Run()
+	cellar.RemoveTempFolders()
+	os.Exit(retCode)
+}
+
+func assert(t *testing.T, err error, op string) {
+	if err != nil {
+		t.Fatalf("%s: %s", op, err)
+	}
+}
+
+var testKey = bytes.Repeat([]byte{7}, 16)
+
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record %03d", i))
+}
+
+// writeStore creates a store with a few sealed chunks
+func writeStore(t *testing.T, count int) (string, []int64) {
+
+	folder := cellar.NewTempFolder("cli")
+
+	w, err := cellar.NewWriter(folder, 200, testKey)
+	assert(t, err, "NewWriter")
+
+	var positions []int64
+	for i := 0; i < count; i++ {
+		positions = append(positions, w.VolatilePos())
+		_, err = w.Append(record(i))
+		assert(t, err, "Append")
+	}
+	assert(t, w.PutUserCheckpoint("report", 42), "PutUserCheckpoint")
+	assert(t, w.Close(), "Close")
+	return folder, positions
+}
+
+func runCLI(t *testing.T, expected int, args ...string) string {
+	var stdout, stderr bytes.Buffer
+	if code := run(args, &stdout, &stderr); code != expected {
+		t.Fatalf("%v exited with %d instead of %d: %s", args, code, expected, stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestCommands(t *testing.T) {
+
+	folder, positions := writeStore(t, 50)
+	key := hex.EncodeToString(testKey)
+
+	info := runCLI(t, exitOK, "info", "-chunks", folder)
+	for _, s := range []string{"total records:      50", ".lz4", "compression ratio:"} {
+		if !strings.Contains(info, s) {
+			t.Fatalf("Expected %q in info:\n%s", s, info)
+		}
+	}
+
+	out := runCLI(t, exitOK, "cat", "-key", key, folder)
+	var expected bytes.Buffer
+	for i := range positions {
+		expected.Write(record(i))
+	}
+	if out != expected.String() {
+		t.Fatalf("Unexpected cat output %q", out)
+	}
+
+	// range picks the records by their positions
+	out = runCLI(t, exitOK, "scan", "-key", key, "-pos",
+		"-start", fmt.Sprint(positions[10]), "-end", fmt.Sprint(positions[13]), folder)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %q", out)
+	}
+	if lines[0] != fmt.Sprintf("%d\t%x", positions[10], record(10)) {
+		t.Fatalf("Unexpected first line %q", lines[0])
+	}
+
+	// length-prefixed output is the binary export
+	out = runCLI(t, exitOK, "scan", "-key", key, "-format", "len", "-end", fmt.Sprint(positions[3]), folder)
+	expected.Reset()
+	for i := 0; i < 3; i++ {
+		expected.WriteByte(byte(len(record(i))))
+		expected.Write(record(i))
+	}
+	if out != expected.String() {
+		t.Fatalf("Unexpected len output %q", out)
+	}
+
+	// failure of the export ends the decoded output
+	runCLI(t, exitFailed, "scan", "-key", hex.EncodeToString(bytes.Repeat([]byte{8}, 16)), folder)
+
+	// key is taken from the environment
+	os.Setenv(keyEnv, key)
+	out = runCLI(t, exitOK, "scan", "-format", "base64", "-start", fmt.Sprint(positions[49]), folder)
+	os.Unsetenv(keyEnv)
+	if out != "cmVjb3JkIDA0OQ==\n" {
+		t.Fatalf("Unexpected base64 output %q", out)
+	}
+
+	runCLI(t, exitUsage, "scan", folder)
+	runCLI(t, exitUsage, "scan", "-key", key, "-format", "xml", folder)
+	runCLI(t, exitFailed, "info", filepath.Join(folder, "missing"))
+
+	runCLI(t, exitOK, "checkpoints", "-key", key, "-set", "report=100", folder)
+	runCLI(t, exitOK, "checkpoints", "-key", key, "-set", "import=7", folder)
+	if out = runCLI(t, exitOK, "checkpoints", folder); out != "import  7\nreport  100\n" {
+		t.Fatalf("Unexpected checkpoints %q", out)
+	}
+
+	runCLI(t, exitOK, "verify", "-key", key, folder)
+}
+
+func TestExportImport(t *testing.T) {
+
+	src, _ := writeStore(t, 50)
+	dst := cellar.NewTempFolder("cli")
+	key := hex.EncodeToString(testKey)
+
+	// key file could hold the raw key
+	keyFile := filepath.Join(src, "key")
+	assert(t, os.WriteFile(keyFile, testKey, 0600), "WriteFile")
+
+	export := filepath.Join(src, "export.bin")
+	runCLI(t, exitOK, "export", "-key-file", keyFile, "-o", export, src)
+	runCLI(t, exitOK, "import", "-key", key, "-buffer", "300", "-i", export, dst)
+
+	if a, b := runCLI(t, exitOK, "cat", "-key", key, src), runCLI(t, exitOK, "cat", "-key", key, dst); a != b {
+		t.Fatalf("Imported %q instead of %q", b, a)
+	}
+
+	// same framing keeps the positions
+	clone := cellar.NewTempFolder("cli")
+	export = filepath.Join(src, "export.json")
+	runCLI(t, exitOK, "export", "-key", key, "-format", "ndjson", "-o", export, src)
+	runCLI(t, exitOK, "import", "-key", key, "-format", "ndjson", "-keep-positions", "-i", export, clone)
+
+	if a, b := runCLI(t, exitOK, "scan", "-key", key, "-pos", src), runCLI(t, exitOK, "scan", "-key", key, "-pos", clone); a != b {
+		t.Fatalf("Imported %q instead of %q", b, a)
+	}
+
+	runCLI(t, exitUsage, "import", "-key", key, "-format", "csv", "-i", export, clone)
+	runCLI(t, exitUsage, "import", "-key", key, "-index", "src", "-i", export, clone)
+
+	out := runCLI(t, exitOK, "export", "-key", key, "-format", "tsv", src)
+	if !strings.HasPrefix(out, "pos\tnext\tsize\tcrc32c\n0\t") {
+		t.Fatalf("Unexpected tsv %q", out)
+	}
+}
+
+func TestVerifyDamage(t *testing.T) {
+
+	folder, _ := writeStore(t, 50)
+
+	info, err := cellar.NewReader(folder, nil).Info()
+	assert(t, err, "Info")
+
+	loc := filepath.Join(folder, info.Chunks[0].FileName)
+	data, err := os.ReadFile(loc)
+	assert(t, err, "ReadFile")
+	data[len(data)/2] ^= 0xFF
+	assert(t, os.WriteFile(loc, data, 0644), "WriteFile")
+
+	out := runCLI(t, exitDamaged, "verify", "-key", hex.EncodeToString(testKey), folder)
+	if !strings.Contains(out, "damaged "+info.Chunks[0].FileName) {
+		t.Fatalf("Expected damaged chunk in %q", out)
+	}
+}
@@ -0,0 +1,253 @@
+package cellar
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+)
+
+// Codec compresses the chunks. Every chunk records the ID of the codec
+// it was written with, so a single store could mix codecs and the
+// readers pick the right one transparently.
+type Codec interface {
+	// ID is recorded in the chunks, it must never change
+	ID() uint32
+	// Name is used as the extension of the chunk files
+	Name() string
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// DefaultLevel picks the default compression level of the codec
+const DefaultLevel = 0
+
+// Built-in codecs. LZ4 has ID 0, which is the codec of the chunks
+// written before the codecs were recorded
+var (
+	CodecLZ4    Codec = lz4Codec{}
+	CodecNone   Codec = noneCodec{}
+	CodecFlate  Codec = flateCodec{}
+	CodecGzip   Codec = gzipCodec{}
+	CodecZstd   Codec = zstdCodec{}
+	CodecSnappy Codec = snappyCodec{}
+)
+
+var (
+	codecs      = make(map[uint32]Codec)
+	codecNameRe = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+)
+
+func init() {
+	for _, c := range []Codec{CodecLZ4, CodecNone, CodecFlate, CodecGzip, CodecZstd, CodecSnappy} {
+		if err := RegisterCodec(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterCodec makes a custom codec available to the writers and the
+// readers. It has to be called before the chunks are written or read,
+// usually from the init of the package providing the codec.
+func RegisterCodec(c Codec) error {
+	if !codecNameRe.MatchString(c.Name()) {
+		return errors.Errorf("Codec name %q is not a valid file extension", c.Name())
+	}
+	if existing, found := codecs[c.ID()]; found {
+		return errors.Errorf("Codec ID %d is already taken by %s", c.ID(), existing.Name())
+	}
+	for _, existing := range codecs {
+		if existing.Name() == c.Name() {
+			return errors.Errorf("Codec name %s is already taken by ID %d", c.Name(), existing.ID())
+		}
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+// LookupCodec returns the registered codec with the given name
+func LookupCodec(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, errors.Wrap(ErrUnknownCodec, name)
+}
+
+// CodecNames lists names of all registered codecs
+func CodecNames() []string {
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CodecByID returns the registered codec with the given ID
+func CodecByID(id uint32) (Codec, error) {
+	c, found := codecs[id]
+	if !found {
+		return nil, errors.Wrapf(ErrUnknownCodec, "codec %d", id)
+	}
+	return c, nil
+}
+
+// checkCodec makes sure the codec is registered and accepts the level,
+// so that a bad setting fails early instead of on the next seal
+func checkCodec(c Codec, level int) error {
+	if registered, found := codecs[c.ID()]; !found || registered.Name() != c.Name() {
+		return errors.Wrapf(ErrUnknownCodec, "codec %s is not registered", c.Name())
+	}
+	w, err := c.NewWriter(ioutil.Discard, level)
+	if err != nil {
+		return errors.Wrapf(err, "%s level %d", c.Name(), level)
+	}
+	return w.Close()
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() uint32   { return 0 }
+func (lz4Codec) Name() string { return "lz4" }
+
+func (lz4Codec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	zw := lz4.NewWriter(w)
+	zw.Header.CompressionLevel = compressionLevel
+	if level != DefaultLevel {
+		zw.Header.CompressionLevel = level
+	}
+	return zw, nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.Reader, error) {
+	zr := lz4Readers.Get().(*lz4.Reader)
+	zr.Reset(r)
+	return &lz4Reader{zr}, nil
+}
+
+// LZ4 readers hold the block buffers, they are reused between the chunks
+var lz4Readers = sync.Pool{
+	New: func() interface{} { return lz4.NewReader(nil) },
+}
+
+// lz4Reader returns the reader to the pool on Close
+type lz4Reader struct {
+	*lz4.Reader
+}
+
+func (z *lz4Reader) Close() error {
+	if z.Reader != nil {
+		z.Reader.Reset(nil)
+		lz4Readers.Put(z.Reader)
+		z.Reader = nil
+	}
+	return nil
+}
+
+// noneCodec stores chunks as they are, which makes sense
+// for the data that is already compressed
+type noneCodec struct{}
+
+func (noneCodec) ID() uint32   { return 1 }
+func (noneCodec) Name() string { return "raw" }
+
+func (noneCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type flateCodec struct{}
+
+func (flateCodec) ID() uint32   { return 2 }
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == DefaultLevel {
+		level = flate.DefaultCompression
+	}
+	return flate.NewWriter(w, level)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint32   { return 3 }
+func (gzipCodec) Name() string { return "gz" }
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if level == DefaultLevel {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) ID() uint32   { return 4 }
+func (zstdCodec) Name() string { return "zst" }
+
+func (zstdCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	speed := zstd.SpeedDefault
+	if level != DefaultLevel {
+		speed = zstd.EncoderLevelFromZstd(level)
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.Reader, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{d}, nil
+}
+
+// zstdReader releases the decoder on Close
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// snappyCodec uses the framing format, it has no levels
+type snappyCodec struct{}
+
+func (snappyCodec) ID() uint32   { return 5 }
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
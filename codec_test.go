@@ -0,0 +1,131 @@
+package cellar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	data := genSeedBytes(100000, 1)
+
+	for _, name := range CodecNames() {
+		codec, err := LookupCodec(name)
+		assert(t, err, "LookupCodec")
+
+		var buf bytes.Buffer
+		zw, err := codec.NewWriter(&buf, DefaultLevel)
+		assert(t, err, "NewWriter")
+		_, err = zw.Write(data)
+		assert(t, err, "Write")
+		assert(t, zw.Close(), "Close")
+
+		zr, err := codec.NewReader(&buf)
+		assert(t, err, "NewReader")
+		actual, err := ioutil.ReadAll(zr)
+		assert(t, err, "ReadAll")
+
+		if !bytes.Equal(actual, data) {
+			t.Fatalf("Codec %s didn't round trip", name)
+		}
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	settings := []struct {
+		codec Codec
+		level int
+	}{
+		{CodecLZ4, DefaultLevel},
+		{CodecNone, DefaultLevel},
+		{CodecFlate, 9},
+		{CodecGzip, 1},
+		{CodecZstd, 19},
+		{CodecSnappy, DefaultLevel},
+	}
+
+	var n int
+	for _, s := range settings {
+		assert(t, w.SetCodec(s.codec, s.level), "SetCodec")
+		for i := 0; i < 20; i++ {
+			_, err = w.Append(genSeedBytes(64, n))
+			assert(t, err, "Append")
+			n++
+		}
+		assert(t, w.SealTheBuffer(), "SealTheBuffer")
+	}
+	assertCheckpoint(t, w)
+
+	used := make(map[uint32]bool)
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+	chunks := listChunks(t, folder, keys)
+	for _, c := range chunks {
+		used[c.Codec] = true
+	}
+	for _, s := range settings {
+		if !used[s.codec.ID()] {
+			t.Fatalf("No chunks were written with %s", s.codec.Name())
+		}
+	}
+	assertFiles(t, folder, chunks)
+	assertRecords(t, folder, key, n)
+
+	report, err := Verify(folder, key)
+	assert(t, err, "Verify")
+	if !report.OK() {
+		t.Fatalf("Expected no damage but got %v", report.Damaged)
+	}
+}
+
+func TestSetCodecFailures(t *testing.T) {
+
+	w, err := NewWriter(getFolder(), 1000, genRandBytes(16))
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	if err = w.SetCodec(CodecFlate, 42); err == nil {
+		t.Fatalf("Expected bad level to fail")
+	}
+	if err = w.SetCodec(fakeCodec{id: 100}, DefaultLevel); errors.Cause(err) != ErrUnknownCodec {
+		t.Fatalf("Expected ErrUnknownCodec but got %v", err)
+	}
+	if err = RegisterCodec(fakeCodec{id: CodecZstd.ID()}); err == nil {
+		t.Fatalf("Expected taken codec ID to fail")
+	}
+}
+
+type fakeCodec struct {
+	noneCodec
+	id uint32
+}
+
+func (f fakeCodec) ID() uint32   { return f.id }
+func (f fakeCodec) Name() string { return "fake" }
+
+func TestUnknownCodec(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	db, err := mdb.New(folder, mdb.NewConfig())
+	assert(t, err, "mdb.New")
+
+	err = db.Update(func(tx *mdb.Tx) error {
+		chunks[0].Codec = 100
+		return lmdbPutChunk(tx, chunks[0].StartPos, chunks[0])
+	})
+	assert(t, err, "Update")
+	db.Close()
+
+	assertScanFails(t, folder, key, ErrUnknownCodec)
+}
@@ -0,0 +1,140 @@
+package cellar
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCompactBatch is the number of source records
+// between the checkpoints of the compaction
+const DefaultCompactBatch = 1000
+
+// TransformFunc turns the source record into the destination one.
+// Returning false drops the record. Data is valid only within the call
+type TransformFunc func(info *ReaderInfo, data []byte) ([]byte, bool, error)
+
+// CompactStats describes a single run of the compaction
+type CompactStats struct {
+	// Read is the number of the source records processed
+	Read int64
+	// Written is the number of the records appended to the destination
+	Written int64
+	// Dropped is the number of the records rejected by the transform
+	Dropped int64
+	// SrcPos is the source position processed so far
+	SrcPos int64
+	// DstPos is the checkpoint of the destination
+	DstPos int64
+}
+
+// Compactor pumps the records from the source cellar into the
+// destination one, passing them through the transform.
+//
+// Position in the source is kept as the user checkpoint of the
+// destination. It is committed together with the destination data, so
+// a crashed run resumes exactly where the durable data ends, without
+// losing or duplicating the records. Every written record is also
+// indexed in the destination under the stream with the checkpoint
+// name: source StartPos maps to the destination StartPos.
+type Compactor struct {
+	Src            *Reader
+	Dst            *Writer
+	Transform      TransformFunc
+	CheckpointName string
+	// BatchSize is the number of the source records between the
+	// checkpoints of the destination, DefaultCompactBatch if 0
+	BatchSize int
+}
+
+// Compact runs the compaction till the end of the source data
+func Compact(src *Reader, dst *Writer, transform TransformFunc, checkpointName string) (*CompactStats, error) {
+	c := &Compactor{Src: src, Dst: dst, Transform: transform, CheckpointName: checkpointName}
+	return c.Run(context.Background())
+}
+
+func (c *Compactor) check() error {
+	if c.Src == nil || c.Dst == nil || c.Transform == nil {
+		return errors.Wrap(ErrInvalidOptions, "source, destination and transform are required")
+	}
+	if len(c.CheckpointName) == 0 {
+		return errors.Wrap(ErrInvalidOptions, "empty checkpoint name")
+	}
+	if filepath.Clean(c.Src.Folder) == filepath.Clean(c.Dst.folder) {
+		return errors.Wrap(ErrInvalidOptions, "source and destination are the same folder")
+	}
+	return nil
+}
+
+// Run compacts the source data that was added since the previous run.
+// Records processed before the failure or cancellation are committed
+// by the next checkpoint of the destination, along with their position.
+func (c *Compactor) Run(ctx context.Context) (*CompactStats, error) {
+
+	var err error
+
+	if err = c.check(); err != nil {
+		return nil, err
+	}
+
+	batch := c.BatchSize
+	if batch <= 0 {
+		batch = DefaultCompactBatch
+	}
+
+	stats := &CompactStats{}
+	if stats.SrcPos, err = c.Dst.GetUserCheckpoint(c.CheckpointName); err != nil {
+		return nil, errors.Wrap(err, "GetUserCheckpoint")
+	}
+
+	src := *c.Src
+	if stats.SrcPos > src.StartPos {
+		src.StartPos = stats.SrcPos
+	}
+
+	var pending int
+
+	err = src.ScanContext(ctx, func(info *ReaderInfo, data []byte) error {
+
+		out, keep, err := c.Transform(info, data)
+		if err != nil {
+			return errors.Wrapf(err, "Transform record at %d", info.StartPos)
+		}
+
+		if keep {
+			pos := c.Dst.VolatilePos()
+			if _, err = c.Dst.Append(out); err != nil {
+				return errors.Wrap(err, "Append")
+			}
+			if err = c.Dst.IndexPosition(c.CheckpointName, uint64(info.StartPos), pos); err != nil {
+				return errors.Wrap(err, "IndexPosition")
+			}
+			stats.Written++
+		} else {
+			stats.Dropped++
+		}
+		stats.Read++
+
+		// staged after the data, any commit from now on
+		// includes both the record and the position
+		c.Dst.StageUserCheckpoint(c.CheckpointName, info.NextPos)
+		stats.SrcPos = info.NextPos
+
+		if pending++; pending >= batch {
+			pending = 0
+			if stats.DstPos, err = c.Dst.Checkpoint(); err != nil {
+				return errors.Wrap(err, "Checkpoint")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if stats.DstPos, err = c.Dst.Checkpoint(); err != nil {
+		return stats, errors.Wrap(err, "Checkpoint")
+	}
+	return stats, nil
+}
@@ -0,0 +1,130 @@
+package cellar
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// keepEven drops the odd records and trims the rest
+func keepEven(info *ReaderInfo, data []byte) ([]byte, bool, error) {
+	if data[0]%2 == 1 {
+		return nil, false, nil
+	}
+	return data[:32], true, nil
+}
+
+func assertCompacted(t *testing.T, folder string, key []byte, count int) {
+	var n int
+	err := NewReader(folder, key).Scan(func(ri *ReaderInfo, data []byte) error {
+		if len(data) != 32 {
+			t.Fatalf("Expected 32 bytes but got %d", len(data))
+		}
+		if err := checkSeedBytes(data, n*2); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+		return nil
+	})
+	assert(t, err, "Scan")
+	if n != count {
+		t.Fatalf("Expected %d compacted records but got %d", count, n)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	srcFolder, dstFolder := getFolder(), getFolder()
+	key := genRandBytes(16)
+	recs := writeChecksummed(t, srcFolder, key, 100)
+
+	dst, err := NewWriter(dstFolder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, dst)
+
+	stats, err := Compact(NewReader(srcFolder, key), dst, keepEven, "raw")
+	assert(t, err, "Compact")
+	if stats.Read != 100 || stats.Written != 50 || stats.Dropped != 50 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	assertCompacted(t, dstFolder, key, 50)
+
+	// source positions map to the compacted records
+	data, _, err := NewReader(dstFolder, key).Get("raw", uint64(recs[10].pos))
+	assert(t, err, "Get")
+	if err = checkSeedBytes(data, 10); err != nil || len(data) != 32 {
+		t.Fatalf("Expected compacted record 10: %v", err)
+	}
+
+	// next run picks up only the new records
+	src, err := NewWriter(srcFolder, 1000, key)
+	assert(t, err, "NewWriter")
+	for i := 100; i < 120; i++ {
+		_, err = src.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, src)
+	closeWriter(t, src)
+
+	stats, err = Compact(NewReader(srcFolder, key), dst, keepEven, "raw")
+	assert(t, err, "Compact")
+	if stats.Read != 20 || stats.Written != 10 {
+		t.Fatalf("Expected 20 new records but got %+v", stats)
+	}
+	assertCompacted(t, dstFolder, key, 60)
+
+	if _, err = Compact(NewReader(dstFolder, key), dst, keepEven, "raw"); errors.Cause(err) != ErrInvalidOptions {
+		t.Fatalf("Expected ErrInvalidOptions for the same folder but got %v", err)
+	}
+}
+
+func TestCompactCrash(t *testing.T) {
+	srcFolder, dstFolder := getFolder(), getFolder()
+	key := genRandBytes(16)
+	writeChecksummed(t, srcFolder, key, 100)
+
+	dst, err := NewWriter(dstFolder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	// crash on the third checkpoint, after a few seals
+	var checkpoints int
+	crashPoint = func(name string) error {
+		if name == crashCheckpointFlushed {
+			if checkpoints++; checkpoints == 3 {
+				return errCrash
+			}
+		}
+		return nil
+	}
+	c := &Compactor{
+		Src:            NewReader(srcFolder, key),
+		Dst:            dst,
+		Transform:      keepEven,
+		CheckpointName: "raw",
+		BatchSize:      15,
+	}
+	_, err = c.Run(context.Background())
+	crashPoint = func(string) error { return nil }
+	if errors.Cause(err) != errCrash {
+		t.Fatalf("Expected crash but got %v", err)
+	}
+	abandon(dst)
+
+	dst, err = NewWriter(dstFolder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, dst)
+
+	from, err := dst.GetUserCheckpoint("raw")
+	assert(t, err, "GetUserCheckpoint")
+	if from == 0 {
+		t.Fatalf("Expected the progress to be saved")
+	}
+
+	c.Dst = dst
+	stats, err := c.Run(context.Background())
+	assert(t, err, "Run")
+	if stats.Read >= 100 {
+		t.Fatalf("Expected to resume, but read %d records", stats.Read)
+	}
+	assertCompacted(t, dstFolder, key, 50)
+}
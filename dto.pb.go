@@ -36,6 +36,13 @@ type ChunkDto struct {
 	Records              int64  `protobuf:"varint,3,opt,name=records" json:"records,omitempty"`
 	FileName             string `protobuf:"bytes,4,opt,name=fileName" json:"fileName,omitempty"`
 	StartPos             int64  `protobuf:"varint,5,opt,name=startPos" json:"startPos,omitempty"`
+	Checksum             uint32 `protobuf:"varint,6,opt,name=checksum" json:"checksum,omitempty"`
+	HasChecksum          bool   `protobuf:"varint,7,opt,name=hasChecksum" json:"hasChecksum,omitempty"`
+	RecordChecksums      bool   `protobuf:"varint,8,opt,name=recordChecksums" json:"recordChecksums,omitempty"`
+	FormatVersion        int32  `protobuf:"varint,9,opt,name=formatVersion" json:"formatVersion,omitempty"`
+	KeyId                uint32 `protobuf:"varint,10,opt,name=keyId" json:"keyId,omitempty"`
+	Codec                uint32 `protobuf:"varint,11,opt,name=codec" json:"codec,omitempty"`
+	SealedAt             int64  `protobuf:"varint,12,opt,name=sealedAt" json:"sealedAt,omitempty"`
 }
 
 func (m *ChunkDto) Reset()                    { *m = ChunkDto{} }
@@ -44,11 +51,12 @@ func (*ChunkDto) ProtoMessage()               {}
 func (*ChunkDto) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
 type BufferDto struct {
-	StartPos int64  `protobuf:"varint,1,opt,name=startPos" json:"startPos,omitempty"`
-	MaxBytes int64  `protobuf:"varint,2,opt,name=maxBytes" json:"maxBytes,omitempty"`
-	Records  int64  `protobuf:"varint,3,opt,name=records" json:"records,omitempty"`
-	Pos      int64  `protobuf:"varint,4,opt,name=pos" json:"pos,omitempty"`
-	FileName string `protobuf:"bytes,5,opt,name=fileName" json:"fileName,omitempty"`
+	StartPos        int64  `protobuf:"varint,1,opt,name=startPos" json:"startPos,omitempty"`
+	MaxBytes        int64  `protobuf:"varint,2,opt,name=maxBytes" json:"maxBytes,omitempty"`
+	Records         int64  `protobuf:"varint,3,opt,name=records" json:"records,omitempty"`
+	Pos             int64  `protobuf:"varint,4,opt,name=pos" json:"pos,omitempty"`
+	FileName        string `protobuf:"bytes,5,opt,name=fileName" json:"fileName,omitempty"`
+	RecordChecksums bool   `protobuf:"varint,6,opt,name=recordChecksums" json:"recordChecksums,omitempty"`
 }
 
 func (m *BufferDto) Reset()                    { *m = BufferDto{} }
@@ -57,8 +65,17 @@ func (*BufferDto) ProtoMessage()               {}
 func (*BufferDto) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
 type MetaDto struct {
-	MaxKeySize int64 `protobuf:"varint,1,opt,name=maxKeySize" json:"maxKeySize,omitempty"`
-	MaxValSize int64 `protobuf:"varint,2,opt,name=maxValSize" json:"maxValSize,omitempty"`
+	MaxKeySize      int64  `protobuf:"varint,1,opt,name=maxKeySize" json:"maxKeySize,omitempty"`
+	MaxValSize      int64  `protobuf:"varint,2,opt,name=maxValSize" json:"maxValSize,omitempty"`
+	BufferSize      int64  `protobuf:"varint,3,opt,name=bufferSize" json:"bufferSize,omitempty"`
+	Codec           uint32 `protobuf:"varint,4,opt,name=codec" json:"codec,omitempty"`
+	Level           int32  `protobuf:"varint,5,opt,name=level" json:"level,omitempty"`
+	RecordChecksums bool   `protobuf:"varint,6,opt,name=recordChecksums" json:"recordChecksums,omitempty"`
+	MapSizeMbs      int64  `protobuf:"varint,7,opt,name=mapSizeMbs" json:"mapSizeMbs,omitempty"`
+	DbFlags         uint32 `protobuf:"varint,8,opt,name=dbFlags" json:"dbFlags,omitempty"`
+	KeyId           uint32 `protobuf:"varint,9,opt,name=keyId" json:"keyId,omitempty"`
+	KeyCheck        []byte `protobuf:"bytes,10,opt,name=keyCheck" json:"keyCheck,omitempty"`
+	LowWaterMark    int64  `protobuf:"varint,11,opt,name=lowWaterMark" json:"lowWaterMark,omitempty"`
 }
 
 func (m *MetaDto) Reset()                    { *m = MetaDto{} }
@@ -75,21 +92,33 @@ func init() {
 func init() { proto.RegisterFile("dto.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 246 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x7c, 0x91, 0xcd, 0x4a, 0xc3, 0x40,
-	0x10, 0xc7, 0x59, 0x63, 0x3f, 0x32, 0x27, 0x59, 0x3c, 0x2c, 0x1e, 0xa4, 0xe4, 0xd4, 0x53, 0x0f,
-	0xfa, 0x06, 0xb5, 0x17, 0x11, 0x45, 0x22, 0x78, 0x5f, 0x93, 0x09, 0x86, 0xee, 0x76, 0xc2, 0xce,
-	0x06, 0x5a, 0x5f, 0xc1, 0x97, 0xf2, 0xd1, 0x64, 0x97, 0x1a, 0x37, 0x50, 0x7a, 0xcb, 0xff, 0x0b,
-	0x7e, 0x99, 0x85, 0xbc, 0xf6, 0xb4, 0xea, 0x1c, 0x79, 0x92, 0xd3, 0x0a, 0x8d, 0xd1, 0xae, 0xf8,
-	0x11, 0x30, 0x7f, 0xf8, 0xec, 0x77, 0xdb, 0x8d, 0x27, 0x79, 0x07, 0xd7, 0xfd, 0xae, 0x22, 0xdb,
-	0x39, 0x64, 0xc6, 0x7a, 0x7d, 0xf0, 0xf8, 0xd6, 0x7e, 0xa1, 0x12, 0x0b, 0xb1, 0xcc, 0xca, 0x93,
-	0x99, 0x5c, 0x81, 0xfc, 0x77, 0x37, 0x2d, 0x6f, 0xe3, 0xe2, 0x22, 0x2e, 0x4e, 0x24, 0x52, 0xc1,
-	0xcc, 0x61, 0x45, 0xae, 0x66, 0x95, 0xc5, 0xd2, 0x9f, 0x94, 0x37, 0x30, 0x6f, 0x5a, 0x83, 0x2f,
-	0xda, 0xa2, 0xba, 0x5c, 0x88, 0x65, 0x5e, 0x0e, 0x3a, 0x64, 0xec, 0xb5, 0xf3, 0xaf, 0xc4, 0x6a,
-	0x12, 0x67, 0x83, 0x2e, 0xbe, 0x05, 0xe4, 0xeb, 0xbe, 0x69, 0xd0, 0x85, 0x7f, 0x48, 0x9b, 0x62,
-	0xdc, 0x0c, 0x99, 0xd5, 0xfb, 0x80, 0xce, 0x47, 0xc2, 0x41, 0x9f, 0xe1, 0xba, 0x82, 0xac, 0x23,
-	0x8e, 0x48, 0x59, 0x19, 0x3e, 0x47, 0xa4, 0x93, 0x31, 0x69, 0xf1, 0x08, 0xb3, 0x67, 0xf4, 0x3a,
-	0xa0, 0xdc, 0x02, 0x58, 0xbd, 0x7f, 0xc2, 0x43, 0x72, 0xc4, 0xc4, 0x39, 0xe6, 0xef, 0xda, 0x24,
-	0x27, 0x4b, 0x9c, 0x8f, 0x69, 0x7c, 0xaa, 0xfb, 0xdf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x8a, 0x58,
-	0x12, 0xdc, 0xb7, 0x01, 0x00, 0x00,
+	// 441 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x93, 0xc1, 0x8e, 0xd3, 0x30,
+	0x10, 0x86, 0x95, 0xcd, 0xa6, 0x4d, 0x66, 0x5b, 0x81, 0xac, 0x1e, 0xac, 0x3d, 0xa0, 0xa8, 0xe2,
+	0x90, 0xd3, 0x1e, 0xe0, 0x09, 0xd8, 0x5d, 0x21, 0x21, 0x54, 0x84, 0x8c, 0xb4, 0x9c, 0xdd, 0x64,
+	0x4a, 0xab, 0x38, 0x75, 0x64, 0xbb, 0xb0, 0xe5, 0x41, 0x78, 0x13, 0x9e, 0x83, 0x57, 0x42, 0x9e,
+	0x34, 0xa9, 0xb7, 0x54, 0x68, 0x8f, 0xff, 0xf7, 0xdb, 0xce, 0xcc, 0x3f, 0x13, 0xc8, 0x2a, 0xa7,
+	0x6f, 0x5a, 0xa3, 0x9d, 0x66, 0xa3, 0x12, 0x95, 0x92, 0x66, 0xfe, 0x2b, 0x86, 0xf4, 0x6e, 0xbd,
+	0xdb, 0xd6, 0xf7, 0x4e, 0xb3, 0x37, 0x30, 0xdb, 0x6d, 0x4b, 0xdd, 0xb4, 0x06, 0xad, 0xc5, 0xea,
+	0x76, 0xef, 0xf0, 0xcb, 0xe6, 0x27, 0xf2, 0x28, 0x8f, 0x8a, 0x58, 0x9c, 0xf5, 0xd8, 0x0d, 0xb0,
+	0x23, 0xbd, 0xdf, 0xd8, 0x9a, 0x6e, 0x5c, 0xd0, 0x8d, 0x33, 0x0e, 0xe3, 0x30, 0x36, 0x58, 0x6a,
+	0x53, 0x59, 0x1e, 0xd3, 0xa1, 0x5e, 0xb2, 0x6b, 0x48, 0x57, 0x1b, 0x85, 0x9f, 0x64, 0x83, 0xfc,
+	0x32, 0x8f, 0x8a, 0x4c, 0x0c, 0xda, 0x7b, 0xd6, 0x49, 0xe3, 0x3e, 0x6b, 0xcb, 0x13, 0xba, 0x36,
+	0x68, 0xef, 0x95, 0x6b, 0x2c, 0x6b, 0xbb, 0x6b, 0xf8, 0x28, 0x8f, 0x8a, 0xa9, 0x18, 0x34, 0xcb,
+	0xe1, 0x6a, 0x2d, 0xed, 0x5d, 0x6f, 0x8f, 0xf3, 0xa8, 0x48, 0x45, 0x88, 0x58, 0x01, 0x2f, 0xba,
+	0x02, 0x7a, 0x62, 0x79, 0x4a, 0xa7, 0x4e, 0x31, 0x7b, 0x0d, 0xd3, 0x95, 0x36, 0x8d, 0x74, 0x0f,
+	0x68, 0xec, 0x46, 0x6f, 0x79, 0x96, 0x47, 0x45, 0x22, 0x9e, 0x42, 0x36, 0x83, 0xa4, 0xc6, 0xfd,
+	0x87, 0x8a, 0x03, 0x95, 0xd2, 0x09, 0x4f, 0x4b, 0x5d, 0x61, 0xc9, 0xaf, 0x3a, 0x4a, 0x82, 0xba,
+	0x42, 0xa9, 0xb0, 0x7a, 0xe7, 0xf8, 0xe4, 0xd0, 0xd5, 0x41, 0xcf, 0x7f, 0x47, 0x90, 0xdd, 0xee,
+	0x56, 0x2b, 0x34, 0x7e, 0x32, 0x61, 0xff, 0xd1, 0xbf, 0xfd, 0x37, 0xf2, 0xd1, 0x0f, 0xc4, 0x1e,
+	0x72, 0x1f, 0xf4, 0x7f, 0xd2, 0x7e, 0x09, 0x71, 0xab, 0x2d, 0x05, 0x1d, 0x8b, 0xb8, 0xed, 0xde,
+	0x19, 0xf2, 0x4f, 0x4e, 0xf2, 0x3f, 0x93, 0xd2, 0xe8, 0x6c, 0x4a, 0xf3, 0x3f, 0x17, 0x30, 0x5e,
+	0xa0, 0x93, 0xbe, 0xea, 0x57, 0x00, 0x8d, 0x7c, 0xfc, 0x88, 0xfb, 0x60, 0x8b, 0x02, 0x72, 0xf0,
+	0x1f, 0xa4, 0x0a, 0x76, 0x26, 0x20, 0xde, 0x5f, 0x52, 0x04, 0xe4, 0x77, 0x0d, 0x04, 0xe4, 0x98,
+	0xea, 0x65, 0x98, 0xea, 0x0c, 0x12, 0x85, 0xdf, 0x51, 0x51, 0x13, 0x89, 0xe8, 0xc4, 0xf3, 0x3b,
+	0xe8, 0xaa, 0x6a, 0xfd, 0x07, 0x16, 0x4b, 0xcb, 0xc7, 0x7d, 0x55, 0x3d, 0xf1, 0x99, 0x56, 0xcb,
+	0xf7, 0x4a, 0x7e, 0xeb, 0x36, 0x65, 0x2a, 0x7a, 0x79, 0x9c, 0x7d, 0x16, 0xce, 0xfe, 0x1a, 0xd2,
+	0x1a, 0xf7, 0xf4, 0x3e, 0x2d, 0xc5, 0x44, 0x0c, 0x9a, 0xcd, 0x61, 0xa2, 0xf4, 0x8f, 0xaf, 0xd2,
+	0xa1, 0x59, 0x48, 0x53, 0xd3, 0x7a, 0xc4, 0xe2, 0x09, 0x5b, 0x8e, 0xe8, 0x8f, 0x7d, 0xfb, 0x77,
+	0x00, 0xb5, 0x91, 0x4e, 0x7a, 0xbe, 0x03, 0x00, 0x00,
 }
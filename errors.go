@@ -0,0 +1,52 @@
+package cellar
+
+import "github.com/pkg/errors"
+
+// Errors returned by the package are wrapped with the context,
+// use errors.Cause to compare them against these values.
+var (
+	// ErrBadKey is returned when the encryption key can't be used
+	ErrBadKey = errors.New("bad encryption key")
+	// ErrUnknownKey is returned when the keyring lacks the key
+	// that the chunk was encrypted with
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrChunkMissing is returned when the chunk file is not on disk
+	ErrChunkMissing = errors.New("chunk file is missing")
+	// ErrBufferMissing is returned when the buffer file is not on disk
+	ErrBufferMissing = errors.New("buffer file is missing")
+	// ErrCorruptChunk is returned when the chunk can't be decrypted
+	// or decompressed
+	ErrCorruptChunk = errors.New("corrupt chunk")
+	// ErrUnknownCodec is returned when the chunk was compressed
+	// with a codec that is not registered
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrAuthFailed is returned when the authenticated chunk
+	// was tampered with or truncated
+	ErrAuthFailed = errors.New("chunk authentication failed")
+	// ErrCorruptRecord is returned when the record framing is broken
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrShortRead is returned when a file has less data than recorded
+	// in the metadata DB
+	ErrShortRead = errors.New("short read")
+	// ErrChecksumMismatch is returned when the data doesn't match its checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrInvalidPosition is returned when there is no record at the requested position
+	ErrInvalidPosition = errors.New("no record at position")
+	// ErrInvalidOptions is returned when the writer options can't be used
+	ErrInvalidOptions = errors.New("invalid options")
+	// ErrLocked is returned when another writer holds the folder
+	ErrLocked = errors.New("folder is locked by another writer")
+	// ErrTruncated is returned when the data before the low-water
+	// mark is requested
+	ErrTruncated = errors.New("position is truncated")
+	// ErrRecordTooLarge is returned when the record doesn't fit into
+	// the buffer and the writer rejects such records
+	ErrRecordTooLarge = errors.New("record is larger than the buffer")
+	// ErrClosed is returned when the writer is used after Close
+	ErrClosed = errors.New("writer is closed")
+	// ErrNotFound is returned when the index has no entry for the key
+	ErrNotFound = errors.New("not found")
+	// ErrPositionMismatch is returned when the imported record
+	// doesn't land at its source position
+	ErrPositionMismatch = errors.New("position mismatch")
+)
@@ -0,0 +1,174 @@
+package cellar
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// writeSealed creates a store with sealed chunks and a non-empty buffer
+func writeSealed(t *testing.T) (folder string, key []byte, b *BufferDto, chunks []*ChunkDto) {
+
+	folder = getFolder()
+	key = genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+
+	err = w.ReadDB(func(tx *mdb.Tx) error {
+		var err error
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return err
+		}
+		chunks, err = lmdbListChunks(tx)
+		return err
+	})
+	assert(t, err, "ReadDB")
+	return
+}
+
+func assertScanFails(t *testing.T, folder string, key []byte, expected error) {
+	reader := NewReader(folder, key)
+	err := reader.Scan(func(pos *ReaderInfo, s []byte) error {
+		return nil
+	})
+	if errors.Cause(err) != expected {
+		t.Fatalf("Expected %s but got %v", expected, err)
+	}
+}
+
+func TestBadKey(t *testing.T) {
+
+	if _, err := NewWriter(getFolder(), 1000, []byte("short")); errors.Cause(err) != ErrBadKey {
+		t.Fatalf("Expected ErrBadKey but got %v", err)
+	}
+
+	folder, _, _, _ := writeSealed(t)
+	assertScanFails(t, folder, []byte("short"), ErrBadKey)
+}
+
+func TestChunkMissing(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	assert(t, os.Remove(path.Join(folder, chunks[0].FileName)), "Remove")
+	assertScanFails(t, folder, key, ErrChunkMissing)
+
+	_, _, err := NewReader(folder, key).ReadAt(chunks[0].StartPos)
+	if errors.Cause(err) != ErrChunkMissing {
+		t.Fatalf("Expected ErrChunkMissing but got %v", err)
+	}
+}
+
+func TestCorruptChunk(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	// garbage in the place of the compression header
+	loc := path.Join(folder, chunks[0].FileName)
+	assert(t, os.Truncate(loc, 16), "Truncate")
+	f, err := os.OpenFile(loc, os.O_WRONLY|os.O_APPEND, 0644)
+	assert(t, err, "OpenFile")
+	_, err = f.Write(genSeedBytes(100, 3))
+	assert(t, err, "Write")
+	f.Close()
+
+	assertScanFails(t, folder, key, ErrAuthFailed)
+}
+
+func TestBufferFailures(t *testing.T) {
+	folder, key, b, _ := writeSealed(t)
+
+	loc := path.Join(folder, b.FileName)
+
+	// size prefix pointing past the end of the buffer
+	f, err := os.OpenFile(loc, os.O_RDWR, 0644)
+	assert(t, err, "OpenFile")
+	_, err = f.WriteAt([]byte{0xFE, 0x01}, 0)
+	assert(t, err, "WriteAt")
+	f.Close()
+	assertScanFails(t, folder, key, ErrCorruptRecord)
+
+	assert(t, os.Truncate(loc, b.Pos-1), "Truncate")
+	assertScanFails(t, folder, key, ErrShortRead)
+
+	assert(t, os.Remove(loc), "Remove")
+	assertScanFails(t, folder, key, ErrBufferMissing)
+}
+
+// writeBufferSize puts the size prefix of the first record in the buffer
+func writeBufferSize(t *testing.T, loc string, size int64) {
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(header, size)
+
+	f, err := os.OpenFile(loc, os.O_RDWR, 0644)
+	assert(t, err, "OpenFile")
+	_, err = f.WriteAt(header[:n], 0)
+	assert(t, err, "WriteAt")
+	f.Close()
+}
+
+func TestHugeRecordSize(t *testing.T) {
+	folder, key, b, _ := writeSealed(t)
+
+	// size that overflows the position of the record end
+	writeBufferSize(t, path.Join(folder, b.FileName), math.MaxInt64-2)
+	assertScanFails(t, folder, key, ErrCorruptRecord)
+
+	r := NewReader(folder, key)
+	r.StartPos = b.StartPos
+	it := r.Iterate()
+	for it.Next() {
+	}
+	if errors.Cause(it.Err()) != ErrCorruptRecord {
+		t.Fatalf("Expected ErrCorruptRecord from the iterator, got %v", it.Err())
+	}
+
+	r = NewReader(folder, key)
+	r.Flags |= RF_Stream
+	if err := r.Scan(func(*ReaderInfo, []byte) error { return nil }); errors.Cause(err) != ErrCorruptRecord {
+		t.Fatalf("Expected ErrCorruptRecord from the stream, got %v", err)
+	}
+
+	if _, _, err := NewReader(folder, key).ReadAt(b.StartPos); errors.Cause(err) != ErrInvalidPosition {
+		t.Fatalf("Expected ErrInvalidPosition from ReadAt, got %v", err)
+	}
+
+	report, err := Verify(folder, key)
+	assert(t, err, "Verify")
+	if report.OK() {
+		t.Fatal("Expected broken framing in the buffer")
+	}
+}
+
+func TestScanAsyncReportsFailure(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	assert(t, os.Remove(path.Join(folder, chunks[0].FileName)), "Remove")
+
+	var count int
+	var failure error
+	for rec := range NewReader(folder, key).ScanAsync(10) {
+		if rec.Err != nil {
+			failure = rec.Err
+			continue
+		}
+		count++
+	}
+	if count != 0 {
+		t.Fatalf("Expected no records but got %d", count)
+	}
+	if errors.Cause(failure) != ErrChunkMissing {
+		t.Fatalf("Expected ErrChunkMissing, got %v", failure)
+	}
+}
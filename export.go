@@ -0,0 +1,333 @@
+package cellar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Format is the portable unencrypted representation of the records
+type Format int
+
+const (
+	// FormatBinary prefixes each record with its length as uvarint
+	FormatBinary Format = iota
+	// FormatNDJSON writes a JSON object per line with the position,
+	// the next position and the base64 payload
+	FormatNDJSON
+	// FormatCSV writes the metadata of the records without the
+	// payloads: position, next position, size and CRC-32C
+	FormatCSV
+	// FormatTSV is FormatCSV separated by tabs
+	FormatTSV
+)
+
+var formatNames = map[Format]string{
+	FormatBinary: "binary",
+	FormatNDJSON: "ndjson",
+	FormatCSV:    "csv",
+	FormatTSV:    "tsv",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat returns the format by its name
+func ParseFormat(name string) (Format, error) {
+	for f, n := range formatNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, errors.Wrapf(ErrInvalidOptions, "unknown format %q", name)
+}
+
+// jsonRecord is a line of FormatNDJSON, payload is base64 encoded
+type jsonRecord struct {
+	Pos  int64  `json:"pos"`
+	Next int64  `json:"next"`
+	Data []byte `json:"data"`
+}
+
+var metadataHeader = []string{"pos", "next", "size", "crc32c"}
+
+// ScanRange is Scan that passes only the records within
+// [StartPos, EndPos) of the reader. Scan skips whole chunks, so
+// records past the EndPos of the last one are passed as well.
+func (r *Reader) ScanRange(op ReadOp) error {
+	err := r.Scan(func(info *ReaderInfo, data []byte) error {
+		if r.EndPos != 0 && info.StartPos >= r.EndPos {
+			return errRangeEnd
+		}
+		return op(info, data)
+	})
+	if errors.Cause(err) == errRangeEnd {
+		return nil
+	}
+	return err
+}
+
+// errRangeEnd stops the scan at the end position of the reader
+var errRangeEnd = errors.New("end of range")
+
+// Export writes the records of the reader in the format and returns
+// their count. Like ScanRange, records that start at or after the
+// EndPos of the reader are not exported.
+func Export(r *Reader, w io.Writer, format Format) (int64, error) {
+
+	out := bufio.NewWriter(w)
+	flush := out.Flush
+
+	var write ReadOp
+
+	switch format {
+	case FormatBinary:
+		header := make([]byte, binary.MaxVarintLen64)
+		write = func(info *ReaderInfo, data []byte) error {
+			n := binary.PutUvarint(header, uint64(len(data)))
+			if _, err := out.Write(header[:n]); err != nil {
+				return err
+			}
+			_, err := out.Write(data)
+			return err
+		}
+	case FormatNDJSON:
+		enc := json.NewEncoder(out)
+		write = func(info *ReaderInfo, data []byte) error {
+			return enc.Encode(&jsonRecord{info.StartPos, info.NextPos, data})
+		}
+	case FormatCSV, FormatTSV:
+		cw := csv.NewWriter(out)
+		if format == FormatTSV {
+			cw.Comma = '\t'
+		}
+		if err := cw.Write(metadataHeader); err != nil {
+			return 0, errors.Wrap(err, "Write header")
+		}
+		row := make([]string, len(metadataHeader))
+		write = func(info *ReaderInfo, data []byte) error {
+			row[0] = strconv.FormatInt(info.StartPos, 10)
+			row[1] = strconv.FormatInt(info.NextPos, 10)
+			row[2] = strconv.Itoa(len(data))
+			row[3] = fmt.Sprintf("%08x", crc32.Checksum(data, crcTable))
+			return cw.Write(row)
+		}
+		flush = func() error {
+			if cw.Flush(); cw.Error() != nil {
+				return cw.Error()
+			}
+			return out.Flush()
+		}
+	default:
+		return 0, errors.Wrapf(ErrInvalidOptions, "unknown format %d", int(format))
+	}
+
+	var count int64
+	err := r.ScanRange(func(info *ReaderInfo, data []byte) error {
+		if err := write(info, data); err != nil {
+			return errors.Wrapf(err, "Write record at %d", info.StartPos)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	if err = flush(); err != nil {
+		return count, errors.Wrap(err, "Flush")
+	}
+	return count, nil
+}
+
+// maxImportRecord is the largest record length accepted by the import
+const maxImportRecord = math.MaxInt32
+
+// DefaultImportBatch is the number of records appended at once
+// by the import
+const DefaultImportBatch = 1000
+
+// Importer appends the records exported by Export to the writer
+type Importer struct {
+	Dst    *Writer
+	Format Format
+	// PositionIndex, if set, indexes the source position of each
+	// record under the stream with this name, so the records could
+	// be found by their old positions. Needs FormatNDJSON
+	PositionIndex string
+	// KeepPositions stops the import with ErrPositionMismatch before
+	// the record that wouldn't land at its source position. Records are
+	// appended one by one then. Needs FormatNDJSON
+	KeepPositions bool
+	// BatchSize is the number of records appended at once,
+	// DefaultImportBatch if 0
+	BatchSize int
+}
+
+// Import appends the records in the format to the writer, keeping
+// their order, and checkpoints. It returns the number of the records
+func Import(r io.Reader, w *Writer, format Format) (int64, error) {
+	i := &Importer{Dst: w, Format: format}
+	return i.Run(r)
+}
+
+func (i *Importer) check() error {
+	if i.Dst == nil {
+		return errors.Wrap(ErrInvalidOptions, "destination is required")
+	}
+	switch i.Format {
+	case FormatBinary:
+		if len(i.PositionIndex) > 0 || i.KeepPositions {
+			return errors.Wrapf(ErrInvalidOptions, "%s format has no positions", i.Format)
+		}
+	case FormatNDJSON:
+	case FormatCSV, FormatTSV:
+		return errors.Wrapf(ErrInvalidOptions, "%s format has no payloads", i.Format)
+	default:
+		return errors.Wrapf(ErrInvalidOptions, "unknown format %d", int(i.Format))
+	}
+	return nil
+}
+
+// Run imports all records from the reader. Records are committed by
+// the checkpoint at the end (or the seals of the buffer on the way),
+// on failure the rest could be discarded with Writer.Rollback
+func (i *Importer) Run(r io.Reader) (int64, error) {
+
+	if err := i.check(); err != nil {
+		return 0, err
+	}
+
+	batch := i.BatchSize
+	if batch <= 0 {
+		batch = DefaultImportBatch
+	}
+
+	in := bufio.NewReader(r)
+
+	var read func() (*jsonRecord, error)
+
+	switch i.Format {
+	case FormatBinary:
+		read = func() (*jsonRecord, error) {
+			size, err := binary.ReadUvarint(in)
+			if err != nil {
+				return nil, err
+			}
+			if size > maxImportRecord {
+				return nil, errors.Wrapf(ErrCorruptRecord, "record length %d", size)
+			}
+			// grows with the data, so a corrupt length
+			// fails on the short input instead of allocating
+			var data bytes.Buffer
+			if _, err = io.CopyN(&data, in, int64(size)); err == io.EOF {
+				// length without the payload
+				return nil, io.ErrUnexpectedEOF
+			}
+			return &jsonRecord{Data: data.Bytes()}, err
+		}
+	case FormatNDJSON:
+		dec := json.NewDecoder(in)
+		read = func() (*jsonRecord, error) {
+			rec := &jsonRecord{}
+			if err := dec.Decode(rec); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	}
+
+	var count int64
+	var records []*jsonRecord
+	var data [][]byte
+
+	for {
+		rec, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, errors.Wrapf(err, "read record %d", count)
+		}
+
+		records = append(records, rec)
+		data = append(data, rec.Data)
+
+		if len(records) == batch {
+			if err = i.append(records, data); err != nil {
+				return count, err
+			}
+			count += int64(len(records))
+			records, data = records[:0], data[:0]
+		}
+	}
+
+	if err := i.append(records, data); err != nil {
+		return count, err
+	}
+	count += int64(len(records))
+
+	if _, err := i.Dst.Checkpoint(); err != nil {
+		return count, errors.Wrap(err, "Checkpoint")
+	}
+	return count, nil
+}
+
+func (i *Importer) append(records []*jsonRecord, data [][]byte) error {
+
+	pos := i.Dst.VolatilePos()
+
+	if i.KeepPositions {
+		// checked before the append, since a seal of
+		// the buffer would commit the misplaced record
+		for _, rec := range records {
+			if rec.Pos != pos {
+				return errors.Wrapf(ErrPositionMismatch, "record from %d would land at %d", rec.Pos, pos)
+			}
+			end, err := i.Dst.Append(rec.Data)
+			if err != nil {
+				return errors.Wrap(err, "Append")
+			}
+			if err = i.index(rec, pos); err != nil {
+				return err
+			}
+			pos = end
+		}
+		return nil
+	}
+
+	ends, err := i.Dst.AppendBatch(data)
+	if err != nil {
+		return errors.Wrap(err, "AppendBatch")
+	}
+
+	for n, rec := range records {
+		if err = i.index(rec, pos); err != nil {
+			return err
+		}
+		pos = ends[n]
+	}
+	return nil
+}
+
+func (i *Importer) index(rec *jsonRecord, pos int64) error {
+	if len(i.PositionIndex) == 0 {
+		return nil
+	}
+	if err := i.Dst.IndexPosition(i.PositionIndex, uint64(rec.Pos), pos); err != nil {
+		return errors.Wrap(err, "IndexPosition")
+	}
+	return nil
+}
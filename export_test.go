@@ -0,0 +1,212 @@
+package cellar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestExportImport(t *testing.T) {
+
+	src := getFolder()
+	key := genRandBytes(16)
+	recs := writeChecksummed(t, src, key, 40)
+
+	for _, format := range []Format{FormatBinary, FormatNDJSON} {
+		t.Run(format.String(), func(t *testing.T) {
+
+			var exported bytes.Buffer
+			count, err := Export(NewReader(src, key), &exported, format)
+			assert(t, err, "Export")
+			if count != int64(len(recs)) {
+				t.Fatalf("Exported %d records instead of %d", count, len(recs))
+			}
+
+			dst := getFolder()
+			w, err := NewWriter(dst, 1000, key)
+			assert(t, err, "NewWriter")
+			w.EnableRecordChecksums()
+
+			// positions are reproduced by the store with the same framing
+			imp := &Importer{Dst: w, Format: format, BatchSize: 7}
+			if format == FormatNDJSON {
+				imp.KeepPositions = true
+				imp.PositionIndex = "src"
+			}
+			count, err = imp.Run(&exported)
+			assert(t, err, "Import")
+			if count != int64(len(recs)) {
+				t.Fatalf("Imported %d records instead of %d", count, len(recs))
+			}
+			closeWriter(t, w)
+
+			assertRecords(t, dst, key, len(recs))
+
+			if format == FormatNDJSON {
+				pos, found, err := NewReader(dst, key).Lookup("src", uint64(recs[5].pos))
+				assert(t, err, "Lookup")
+				if !found || pos != recs[5].pos {
+					t.Fatalf("Expected index entry for %d, got %d %t", recs[5].pos, pos, found)
+				}
+			}
+		})
+	}
+}
+
+func TestExportRange(t *testing.T) {
+
+	src := getFolder()
+	key := genRandBytes(16)
+	recs := writeChecksummed(t, src, key, 40)
+
+	r := NewReader(src, key)
+	r.StartPos = recs[10].pos
+	r.EndPos = recs[20].pos
+
+	var exported bytes.Buffer
+	count, err := Export(r, &exported, FormatNDJSON)
+	assert(t, err, "Export")
+	if count != 10 {
+		t.Fatalf("Expected 10 records in range, got %d", count)
+	}
+
+	var first, last int64 = -1, -1
+	err = r.ScanRange(func(info *ReaderInfo, data []byte) error {
+		if first < 0 {
+			first = info.StartPos
+		}
+		last = info.StartPos
+		return nil
+	})
+	assert(t, err, "ScanRange")
+	if first != recs[10].pos || last != recs[19].pos {
+		t.Fatalf("Expected range %d..%d, got %d..%d", recs[10].pos, recs[19].pos, first, last)
+	}
+
+	line := strings.SplitN(exported.String(), "\n", 2)[0]
+	if !strings.HasPrefix(line, fmt.Sprintf(`{"pos":%d,"next":%d,"data":"`, recs[10].pos, recs[11].pos)) {
+		t.Fatalf("Unexpected first line %s", line)
+	}
+
+	// empty store can't put the range at its source positions
+	w, err := NewWriter(getFolder(), 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	imp := &Importer{Dst: w, Format: FormatNDJSON, KeepPositions: true}
+	_, err = imp.Run(&exported)
+	if errors.Cause(err) != ErrPositionMismatch {
+		t.Fatalf("Expected ErrPositionMismatch, got %v", err)
+	}
+	_, err = w.Rollback()
+	assert(t, err, "Rollback")
+}
+
+func TestImportStopsBeforeMismatch(t *testing.T) {
+
+	src := getFolder()
+	key := genRandBytes(16)
+	writeChecksummed(t, src, key, 40)
+
+	var exported bytes.Buffer
+	_, err := Export(NewReader(src, key), &exported, FormatNDJSON)
+	assert(t, err, "Export")
+
+	// records without checksums are shorter, so only the first one
+	// lands at its source position. The rest of the batch would
+	// overflow the buffer and seal it
+	dst := getFolder()
+	w, err := NewWriter(dst, 1000, key)
+	assert(t, err, "NewWriter")
+
+	imp := &Importer{Dst: w, Format: FormatNDJSON, KeepPositions: true}
+	_, err = imp.Run(&exported)
+	if errors.Cause(err) != ErrPositionMismatch {
+		t.Fatalf("Expected ErrPositionMismatch, got %v", err)
+	}
+	if pos := w.VolatilePos(); pos != int64(w.framedSize(64)) {
+		t.Fatalf("Expected only the first record appended, writer is at %d", pos)
+	}
+	assert(t, w.CloseWithoutCheckpoint(), "CloseWithoutCheckpoint")
+
+	if chunks := listChunks(t, dst, nil); len(chunks) != 0 {
+		t.Fatalf("Expected nothing sealed, got %d chunks", len(chunks))
+	}
+	assertRecords(t, dst, key, 0)
+}
+
+func TestExportMetadata(t *testing.T) {
+
+	src := getFolder()
+	key := genRandBytes(16)
+	recs := writeChecksummed(t, src, key, 40)
+
+	for _, format := range []Format{FormatCSV, FormatTSV} {
+
+		var exported bytes.Buffer
+		_, err := Export(NewReader(src, key), &exported, format)
+		assert(t, err, "Export")
+
+		cr := csv.NewReader(&exported)
+		if format == FormatTSV {
+			cr.Comma = '\t'
+		}
+		rows, err := cr.ReadAll()
+		assert(t, err, "ReadAll")
+
+		if len(rows) != len(recs)+1 {
+			t.Fatalf("Expected %d rows with header, got %d", len(recs)+1, len(rows))
+		}
+		if strings.Join(rows[0], ",") != "pos,next,size,crc32c" {
+			t.Fatalf("Unexpected header %v", rows[0])
+		}
+		row := rows[4]
+		expected := []string{
+			fmt.Sprint(recs[3].pos),
+			fmt.Sprint(recs[4].pos),
+			"64",
+			fmt.Sprintf("%08x", crc32.Checksum(genSeedBytes(64, 3), crcTable)),
+		}
+		if strings.Join(row, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Expected %v, got %v", expected, row)
+		}
+
+		w, err := NewWriter(getFolder(), 1000, key)
+		assert(t, err, "NewWriter")
+		if _, err = Import(&exported, w, format); errors.Cause(err) != ErrInvalidOptions {
+			t.Fatalf("Expected ErrInvalidOptions on %s import, got %v", format, err)
+		}
+		closeWriter(t, w)
+	}
+}
+
+func TestImportCorruptLength(t *testing.T) {
+
+	w, err := NewWriter(getFolder(), 1000, genRandBytes(16))
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	header := make([]byte, binary.MaxVarintLen64)
+
+	n := binary.PutUvarint(header, math.MaxUint64)
+	if _, err = Import(bytes.NewReader(header[:n]), w, FormatBinary); errors.Cause(err) != ErrCorruptRecord {
+		t.Fatalf("Expected ErrCorruptRecord, got %v", err)
+	}
+
+	// length is within the limit, but the payload is missing
+	n = binary.PutUvarint(header, 1<<30)
+	input := append(header[:n:n], "short"...)
+	if _, err = Import(bytes.NewReader(input), w, FormatBinary); errors.Cause(err) != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	_, err = w.Rollback()
+	assert(t, err, "Rollback")
+}
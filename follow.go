@@ -0,0 +1,204 @@
+package cellar
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// DefaultPollInterval is how often Follow checks the metadata DB
+// for new checkpoints, unless Reader.PollInterval is set
+const DefaultPollInterval = 100 * time.Millisecond
+
+// Follow replays records starting from the position and then keeps
+// waiting for the new ones, passing them to the op as the writer
+// checkpoints them. It returns only when the context is cancelled
+// or the op fails.
+//
+// New data is discovered by polling the metadata DB, records that
+// move from the buffer into a sealed chunk are not delivered twice.
+func (r *Reader) Follow(ctx context.Context, fromPos int64, op ReadOp) error {
+
+	var db *mdb.DB
+	var err error
+
+	cfg := mdb.NewConfig()
+	if db, err = mdb.New(r.Folder, cfg); err != nil {
+		return errors.Wrap(err, "mdb.New")
+	}
+
+	defer db.Close()
+
+	var keys *Keyring
+	if keys, err = r.keyring(); err != nil {
+		return err
+	}
+
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	f := &follower{
+		folder: r.Folder,
+		keys:   keys,
+		op:     op,
+		pos:    fromPos,
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err = f.poll(ctx, db); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// follower keeps track of the position between the polls
+type follower struct {
+	folder string
+	keys   *Keyring
+	op     ReadOp
+	// next position to deliver
+	pos int64
+	// buffer data that was loaded so far
+	buffer     []byte
+	bufferName string
+}
+
+// poll delivers everything that was committed past the position
+func (f *follower) poll(ctx context.Context, db *mdb.DB) error {
+
+	var b *BufferDto
+	var chunks []*ChunkDto
+
+	err := db.Read(func(tx *mdb.Tx) error {
+		var err error
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		if chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "db.Read")
+	}
+
+	info := &ReaderInfo{}
+	loader := &fileLoader{folder: f.folder, keys: f.keys, db: db}
+
+	for _, c := range chunks {
+
+		if c.StartPos+c.UncompressedByteSize <= f.pos {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		var chunk []byte
+		if chunk, err = loader.chunk(c); err != nil {
+			return errors.Wrapf(err, "Failed to load chunk %s", c.FileName)
+		}
+
+		info.ChunkPos = c.StartPos
+		if err = f.replay(ctx, info, chunk, c.RecordChecksums); err != nil {
+			return err
+		}
+	}
+
+	if b == nil || b.StartPos+b.Pos <= f.pos || b.StartPos > f.pos {
+		return nil
+	}
+
+	var data []byte
+	if data, err = f.loadBuffer(b); err != nil {
+		if errors.Cause(err) == ErrBufferMissing {
+			// buffer got sealed, the chunk will show up on the next poll
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to load buffer %s", b.FileName)
+	}
+
+	info.ChunkPos = b.StartPos
+	return f.replay(ctx, info, data, b.RecordChecksums)
+}
+
+func (f *follower) replay(ctx context.Context, info *ReaderInfo, data []byte, checksums bool) error {
+
+	op := func(ri *ReaderInfo, record []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f.op(ri, record); err != nil {
+			return err
+		}
+		f.pos = ri.NextPos
+		return nil
+	}
+
+	start := 0
+	if f.pos > info.ChunkPos {
+		start = int(f.pos - info.ChunkPos)
+	}
+	if err := replayChunk(info, data, op, start, checksums); err != nil {
+		return errors.Wrap(err, "Failed to read chunk")
+	}
+	return nil
+}
+
+// loadBuffer reads the checkpointed part of the buffer, loading only
+// the bytes that were added since the previous poll
+func (f *follower) loadBuffer(b *BufferDto) ([]byte, error) {
+
+	if f.bufferName != b.FileName {
+		f.buffer = f.buffer[:0]
+		f.bufferName = b.FileName
+	}
+
+	loaded := int64(len(f.buffer))
+	if loaded >= b.Pos {
+		return f.buffer[:b.Pos], nil
+	}
+
+	loc := path.Join(f.folder, b.FileName)
+
+	var file *os.File
+	var err error
+
+	if file, err = os.Open(loc); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(ErrBufferMissing, loc)
+		}
+		return nil, errors.Wrap(err, "os.Open")
+	}
+	defer file.Close()
+
+	// records handed out before stay intact
+	data := make([]byte, b.Pos)
+	copy(data, f.buffer)
+
+	if _, err = file.ReadAt(data[loaded:], loaded); err != nil {
+		if err == io.EOF {
+			return nil, errors.Wrapf(ErrShortRead, "buffer %s", loc)
+		}
+		return nil, errors.Wrap(err, "ReadAt")
+	}
+
+	f.buffer = data
+	return data, nil
+}
@@ -0,0 +1,86 @@
+package cellar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFollow(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	var n int
+	var ends []int64
+	appendBatch := func(count int) {
+		for i := 0; i < count; i++ {
+			pos, err := w.Append(genSeedBytes(64, n))
+			assert(t, err, "Append")
+			ends = append(ends, pos)
+			n++
+		}
+		assertCheckpoint(t, w)
+	}
+
+	appendBatch(20)
+	// skip the first record
+	start := ends[0]
+
+	reader := NewReader(folder, key)
+	reader.PollInterval = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recs := make(chan *Rec, 100)
+	done := make(chan error)
+
+	go func() {
+		done <- reader.Follow(ctx, start, func(ri *ReaderInfo, data []byte) error {
+			recs <- &Rec{Data: data, ChunkPos: ri.ChunkPos, StartPos: ri.StartPos, NextPos: ri.NextPos}
+			return nil
+		})
+	}()
+
+	expect := func(upTo int, seen *int) {
+		for *seen < upTo {
+			select {
+			case rec := <-recs:
+				if err := checkSeedBytes(rec.Data, *seen); err != nil {
+					t.Fatalf("Failed seed check: %s", err)
+				}
+				*seen++
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected %d records but got %d", upTo, *seen)
+			}
+		}
+	}
+
+	seen := 1
+	expect(20, &seen)
+
+	// appends cross the buffer seals
+	for batch := 0; batch < 5; batch++ {
+		appendBatch(7)
+		expect(n, &seen)
+	}
+
+	// nothing is delivered twice
+	select {
+	case rec := <-recs:
+		t.Fatalf("Unexpected record at %d", rec.StartPos)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	if err = <-done; errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected context.Canceled but got %v", err)
+	}
+}
@@ -1,11 +1,16 @@
 module github.com/abdullin/cellar
 
+go 1.16
+
 require (
 	github.com/abdullin/lex-go v0.0.0-20170809071836-51ee1bbe34a4
 	github.com/abdullin/mdb v0.0.0-20171224093530-b63d30c6dad8
 	github.com/bmatsuo/lmdb-go v1.8.0
 	github.com/golang/protobuf v1.2.0
+	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.11.13
 	github.com/pierrec/lz4 v0.0.0-20181005164709-635575b42742
-	github.com/pierrec/xxHash v0.1.1 // indirect
 	github.com/pkg/errors v0.8.0
 )
+
+require github.com/pierrec/xxHash v0.1.1 // indirect
@@ -0,0 +1,78 @@
+package cellar
+
+import (
+	"math"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// MaxIndexKey is the largest key that could be stored in the index.
+// Keys are packed as signed tuple elements, so larger values would
+// break the ordering of range lookups
+const MaxIndexKey uint64 = math.MaxInt64
+
+type indexEntry struct {
+	stream string
+	key    uint64
+	pos    int64
+}
+
+// IndexPosition maps the key within the stream to a global position
+// (usually the StartPos of a record). Entries become visible to the
+// readers atomically with the data, when the next Checkpoint (or the
+// buffer seal) is committed.
+func (w *Writer) IndexPosition(stream string, key uint64, pos int64) error {
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+	if len(stream) == 0 {
+		return errors.New("empty stream name")
+	}
+	if key > MaxIndexKey {
+		return errors.Errorf("Index key %d is larger than %d", key, MaxIndexKey)
+	}
+	w.pendingIndex = append(w.pendingIndex, indexEntry{stream, key, pos})
+	return nil
+}
+
+// Lookup returns the position that was indexed for the key within the stream
+func (r *Reader) Lookup(stream string, key uint64) (pos int64, found bool, err error) {
+
+	err = r.ReadDB(func(tx *mdb.Tx) error {
+		var err error
+		pos, found, err = lmdbLookupPosition(tx, stream, key)
+		return err
+	})
+
+	if err != nil {
+		return 0, false, errors.Wrap(err, "lmdbLookupPosition")
+	}
+	return pos, found, nil
+}
+
+// LookupRange passes all index entries of the stream with keys in the
+// [from, to) range to the op, in the order of keys.
+func (r *Reader) LookupRange(stream string, from, to uint64, op func(key uint64, pos int64) error) error {
+	err := r.ReadDB(func(tx *mdb.Tx) error {
+		return lmdbScanIndex(tx, stream, from, to, op)
+	})
+	if err != nil {
+		return errors.Wrap(err, "lmdbScanIndex")
+	}
+	return nil
+}
+
+// Get loads the record behind the indexed key. It returns
+// ErrNotFound if the key is not in the index
+func (r *Reader) Get(stream string, key uint64) ([]byte, *ReaderInfo, error) {
+
+	pos, found, err := r.Lookup(stream, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, errors.Wrapf(ErrNotFound, "%s/%d", stream, key)
+	}
+	return r.ReadAt(pos)
+}
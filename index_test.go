@@ -0,0 +1,72 @@
+package cellar
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIndexPosition(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	defer closeWriter(t, w)
+
+	positions := make(map[uint64]int64)
+
+	for i := 0; i < 30; i++ {
+		pos := w.VolatilePos()
+		if _, err = w.Append(genSeedBytes(64, i)); err != nil {
+			t.Fatalf("Append failed: %s", err)
+		}
+		k := uint64(i * 10)
+		assert(t, w.IndexPosition("stream", k, pos), "IndexPosition")
+		assert(t, w.IndexPosition("other", k, -1), "IndexPosition")
+		positions[k] = pos
+	}
+
+	reader := NewReader(folder, key)
+
+	// the last entries are not visible before the checkpoint
+	if _, found, err := reader.Lookup("stream", 290); err != nil || found {
+		t.Fatalf("Entry should not be visible before checkpoint: %v", err)
+	}
+
+	assertCheckpoint(t, w)
+
+	for k, expected := range positions {
+		pos, found, err := reader.Lookup("stream", k)
+		assert(t, err, "Lookup")
+		if !found || pos != expected {
+			t.Fatalf("Expected %d to map to %d but got %d (%t)", k, expected, pos, found)
+		}
+	}
+
+	var keys []uint64
+	err = reader.LookupRange("stream", 95, 200, func(k uint64, pos int64) error {
+		if positions[k] != pos {
+			t.Fatalf("Expected %d to map to %d but got %d", k, positions[k], pos)
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	assert(t, err, "LookupRange")
+
+	if len(keys) != 10 || keys[0] != 100 || keys[9] != 190 {
+		t.Fatalf("Unexpected range lookup result %v", keys)
+	}
+
+	data, info, err := reader.Get("stream", 120)
+	assert(t, err, "Get")
+	if info.StartPos != positions[120] {
+		t.Fatalf("Expected record at %d but got %d", positions[120], info.StartPos)
+	}
+	assert(t, checkSeedBytes(data, 12), "checkSeedBytes")
+
+	if _, _, err = reader.Get("stream", 121); errors.Cause(err) != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound but got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package cellar
+
+import (
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// StoreInfo describes the contents of the store, as recorded
+// in the metadata DB
+type StoreInfo struct {
+	// Meta is nil for the stores that were never opened for writing
+	Meta        *MetaDto
+	Buffer      *BufferDto
+	Chunks      []*ChunkDto
+	Checkpoints map[string]int64
+}
+
+// Info loads the description of the store. It doesn't need the key
+func (r *Reader) Info() (*StoreInfo, error) {
+
+	info := &StoreInfo{}
+
+	err := r.ReadDB(func(tx *mdb.Tx) error {
+		var err error
+		if info.Meta, err = lmdbGetCellarMeta(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetCellarMeta")
+		}
+		if info.Buffer, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		if info.Chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		if info.Checkpoints, err = lmdbListUserCheckpoints(tx); err != nil {
+			return errors.Wrap(err, "lmdbListUserCheckpoints")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
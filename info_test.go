@@ -0,0 +1,40 @@
+package cellar
+
+import "testing"
+
+func TestInfo(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	w.StageUserCheckpoint("import", 42)
+	closeWriter(t, w)
+
+	// info doesn't need the key
+	info, err := NewReader(folder, nil).Info()
+	assert(t, err, "Info")
+
+	if info.Meta == nil || info.Meta.BufferSize != 1000 {
+		t.Fatalf("Unexpected meta %v", info.Meta)
+	}
+	if len(info.Chunks) == 0 {
+		t.Fatalf("Expected sealed chunks")
+	}
+
+	var records int64
+	for _, c := range info.Chunks {
+		records += c.Records
+	}
+	if records+info.Buffer.Records != 40 {
+		t.Fatalf("Expected 40 records, got %d in chunks and %d in buffer", records, info.Buffer.Records)
+	}
+	if len(info.Checkpoints) != 1 || info.Checkpoints["import"] != 42 {
+		t.Fatalf("Unexpected checkpoints %v", info.Checkpoints)
+	}
+}
@@ -0,0 +1,281 @@
+package cellar
+
+import (
+	"io"
+	"sort"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// Iterator pulls records one by one, decoding a single chunk at a time.
+// It works against the snapshot of the chunks and the buffer taken by
+// the first call to Next or Seek and honours the settings of the
+// reader (StartPos, EndPos, LimitChunks and RF_LoadBuffer).
+//
+//	it := reader.Iterate()
+//	for it.Next() {
+//		process(it.Info(), it.Record())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	r      *Reader
+	keys   *Keyring
+	loaded bool
+
+	chunks []*ChunkDto
+	b      *BufferDto
+
+	// index of the next source to load, chunks are followed by the buffer
+	next int
+	// offset to start the next source from, set by Seek
+	offset int64
+
+	data      []byte
+	pos       int
+	checksums bool
+
+	info   ReaderInfo
+	record []byte
+	err    error
+}
+
+// Iterate creates a pull iterator over the records
+func (r *Reader) Iterate() *Iterator {
+	return &Iterator{r: r}
+}
+
+// Next advances to the next record, returning false when there are
+// no more records or the iteration failed. Check Err afterwards
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.loaded {
+		if it.err = it.load(); it.err != nil {
+			return false
+		}
+		it.seek(it.r.StartPos)
+	}
+
+	for it.pos >= len(it.data) {
+		var more bool
+		if more, it.err = it.loadNext(); !more || it.err != nil {
+			return false
+		}
+	}
+
+	start := it.pos
+	var err error
+	if it.record, it.pos, err = sliceRecord(it.data, start, it.checksums); err != nil {
+		it.err = errors.Wrapf(err, "record at %d", it.info.ChunkPos+int64(start))
+		return false
+	}
+
+	it.info.StartPos = it.info.ChunkPos + int64(start)
+	it.info.NextPos = it.info.ChunkPos + int64(it.pos)
+	return true
+}
+
+// Record returns the current record. It is valid until the iterator
+// moves past the chunk, copy it to keep it longer
+func (it *Iterator) Record() []byte {
+	return it.record
+}
+
+// Info returns the positions of the current record
+func (it *Iterator) Info() *ReaderInfo {
+	return &it.info
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Seek positions the iterator, so that the following Next returns the
+// record at the global position, following the conventions of io.Seeker:
+// offset is relative to the start of the store, to the position of the
+// next record or to the end of the snapshot. The position has to be a
+// record boundary, like ReaderInfo.StartPos or NextPos. Seek clears the
+// error of the previous iteration and returns the new position.
+func (it *Iterator) Seek(offset int64, whence int) (int64, error) {
+	if !it.loaded {
+		if err := it.load(); err != nil {
+			return 0, err
+		}
+		it.seek(it.r.StartPos)
+	}
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = it.current() + offset
+	case io.SeekEnd:
+		pos = it.end() + offset
+	default:
+		return 0, errors.Errorf("Unknown whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, errors.Wrapf(ErrInvalidPosition, "%d", pos)
+	}
+	it.err = nil
+	it.seek(pos)
+	return pos, nil
+}
+
+// current returns the position of the next record
+func (it *Iterator) current() int64 {
+	if it.data == nil {
+		return it.sourceStart(it.next) + it.offset
+	}
+	return it.info.ChunkPos + int64(it.pos)
+}
+
+// end returns the position past the last record of the snapshot
+func (it *Iterator) end() int64 {
+	if it.b != nil {
+		return it.b.StartPos + it.b.Pos
+	}
+	if n := len(it.chunks); n > 0 {
+		return it.chunks[n-1].StartPos + it.chunks[n-1].UncompressedByteSize
+	}
+	return 0
+}
+
+func (it *Iterator) sourceStart(i int) int64 {
+	if i < len(it.chunks) {
+		return it.chunks[i].StartPos
+	}
+	if it.b != nil {
+		return it.b.StartPos
+	}
+	return it.end()
+}
+
+// load reads the state of the metadata
+func (it *Iterator) load() error {
+
+	var err error
+
+	if it.keys, err = it.r.keyring(); err != nil {
+		return err
+	}
+	if it.b, it.chunks, err = it.r.loadState(); err != nil {
+		return err
+	}
+	it.loaded = true
+	return nil
+}
+
+// loadState lists the chunks and the buffer to read, taking into
+// account the settings of the reader
+func (r *Reader) loadState() (*BufferDto, []*ChunkDto, error) {
+
+	var db *mdb.DB
+	var err error
+
+	cfg := mdb.NewConfig()
+	if db, err = mdb.New(r.Folder, cfg); err != nil {
+		return nil, nil, errors.Wrap(err, "mdb.New")
+	}
+
+	defer db.Close()
+
+	var b *BufferDto
+	var chunks []*ChunkDto
+
+	err = db.Read(func(tx *mdb.Tx) error {
+		var err error
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		if chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "db.Read")
+	}
+
+	if r.LimitChunks > 0 && len(chunks) > r.LimitChunks {
+		chunks = chunks[:r.LimitChunks]
+	}
+	if end := r.EndPos; end != 0 {
+		i := sort.Search(len(chunks), func(i int) bool {
+			return chunks[i].StartPos > end
+		})
+		chunks = chunks[:i]
+	}
+
+	loadBuffer := (r.Flags & RF_LoadBuffer) == RF_LoadBuffer
+	if !loadBuffer || (b != nil && r.EndPos != 0 && b.StartPos > r.EndPos) {
+		b = nil
+	}
+	return b, chunks, nil
+}
+
+// seek picks the source that contains the position
+func (it *Iterator) seek(pos int64) {
+	it.data = nil
+	it.pos = 0
+	it.record = nil
+
+	it.next = sort.Search(len(it.chunks), func(i int) bool {
+		c := it.chunks[i]
+		return c.StartPos+c.UncompressedByteSize > pos
+	})
+	it.offset = 0
+
+	if start := it.sourceStart(it.next); pos > start {
+		it.offset = pos - start
+	}
+}
+
+// loadNext loads the next chunk or the buffer, returns false
+// when there is nothing left
+func (it *Iterator) loadNext() (bool, error) {
+
+	var err error
+
+	offset := it.offset
+	it.offset = 0
+
+	if it.next < len(it.chunks) {
+		c := it.chunks[it.next]
+		it.next++
+
+		var data []byte
+		if data, err = it.r.loader(it.keys).chunk(c); err != nil {
+			return false, errors.Wrapf(err, "Failed to load chunk %s", c.FileName)
+		}
+
+		it.setSource(c.StartPos, data, offset, c.RecordChecksums)
+		return true, nil
+	}
+
+	if it.next == len(it.chunks) && it.b != nil && it.b.Pos > 0 {
+		it.next++
+
+		var data []byte
+		if data, err = it.r.loader(it.keys).buffer(it.b); err != nil {
+			return false, errors.Wrapf(err, "Failed to load buffer %s", it.b.FileName)
+		}
+		it.setSource(it.b.StartPos, data, offset, it.b.RecordChecksums)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (it *Iterator) setSource(startPos int64, data []byte, offset int64, checksums bool) {
+	it.info.ChunkPos = startPos
+	it.data = data
+	it.pos = int(offset)
+	it.checksums = checksums
+}
@@ -0,0 +1,91 @@
+package cellar
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIterator(t *testing.T) {
+	folder, key, b, _ := writeSealed(t)
+
+	var infos []ReaderInfo
+	err := NewReader(folder, key).Scan(func(ri *ReaderInfo, data []byte) error {
+		infos = append(infos, *ri)
+		return nil
+	})
+	assert(t, err, "Scan")
+
+	it := NewReader(folder, key).Iterate()
+
+	var n int
+	for it.Next() {
+		if err = checkSeedBytes(it.Record(), n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		if *it.Info() != infos[n] {
+			t.Fatalf("Expected %v but got %v", infos[n], *it.Info())
+		}
+		n++
+	}
+	assert(t, it.Err(), "Err")
+	if n != len(infos) {
+		t.Fatalf("Expected %d records but got %d", len(infos), n)
+	}
+
+	// seek into the chunk and into the buffer
+	for _, i := range []int{17, len(infos) - 2} {
+		_, err = it.Seek(infos[i].StartPos, io.SeekStart)
+		assert(t, err, "Seek")
+		if !it.Next() {
+			t.Fatalf("Expected record after seek: %v", it.Err())
+		}
+		if err = checkSeedBytes(it.Record(), i); err != nil {
+			t.Fatalf("Failed seed check after seek to %d: %s", i, err)
+		}
+	}
+	if infos[len(infos)-2].ChunkPos != b.StartPos {
+		t.Fatalf("Expected the last records to be in the buffer")
+	}
+
+	// relative seek skips a record
+	_, err = it.Seek(infos[3].StartPos, io.SeekStart)
+	assert(t, err, "Seek")
+	pos, err := it.Seek(infos[4].StartPos-infos[3].StartPos, io.SeekCurrent)
+	assert(t, err, "Seek")
+	if !it.Next() || pos != infos[4].StartPos || checkSeedBytes(it.Record(), 4) != nil {
+		t.Fatalf("Expected record 4 at %d after relative seek", pos)
+	}
+
+	// seek to the end
+	pos, err = it.Seek(0, io.SeekEnd)
+	assert(t, err, "Seek")
+	if pos != infos[len(infos)-1].NextPos {
+		t.Fatalf("Expected end at %d but got %d", infos[len(infos)-1].NextPos, pos)
+	}
+	if it.Next() {
+		t.Fatalf("Expected no records past the end")
+	}
+	assert(t, it.Err(), "Err")
+}
+
+func TestIteratorFailure(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	assert(t, os.Remove(path.Join(folder, chunks[1].FileName)), "Remove")
+
+	it := NewReader(folder, key).Iterate()
+	var n int
+	for it.Next() {
+		n++
+	}
+	if errors.Cause(it.Err()) != ErrChunkMissing {
+		t.Fatalf("Expected ErrChunkMissing but got %v", it.Err())
+	}
+	if int64(n) != chunks[0].Records {
+		t.Fatalf("Expected %d records before the failure but got %d", chunks[0].Records, n)
+	}
+}
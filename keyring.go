@@ -0,0 +1,87 @@
+package cellar
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Keyring holds encryption keys by their IDs. Each chunk records the
+// ID of the key it was encrypted with, new chunks use the current key.
+// Keyring should not be modified while it is used by a writer or a
+// reader.
+type Keyring struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewKeyring creates an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[uint32][]byte)}
+}
+
+// singleKey wraps the raw key into a keyring with it under ID 0,
+// which is the ID recorded by default in chunks
+func singleKey(key []byte) (*Keyring, error) {
+	k := NewKeyring()
+	if err := k.Add(0, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add registers the key under the ID. The first key added becomes
+// the current one.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	if err := checkKey(key); err != nil {
+		return errors.Wrapf(err, "key %d", id)
+	}
+	if _, found := k.keys[id]; found {
+		return errors.Errorf("Key %d is already registered", id)
+	}
+	if len(k.keys) == 0 {
+		k.current = id
+	}
+	k.keys[id] = key
+	return nil
+}
+
+// SetCurrent picks the key that will be used to encrypt new chunks
+func (k *Keyring) SetCurrent(id uint32) error {
+	if _, found := k.keys[id]; !found {
+		return errors.Wrapf(ErrUnknownKey, "key %d", id)
+	}
+	k.current = id
+	return nil
+}
+
+// Current returns ID and the key to encrypt new chunks with
+func (k *Keyring) Current() (uint32, []byte) {
+	return k.current, k.keys[k.current]
+}
+
+// Key returns the key with the given ID
+func (k *Keyring) Key(id uint32) ([]byte, error) {
+	key, found := k.keys[id]
+	if !found {
+		return nil, errors.Wrapf(ErrUnknownKey, "key %d", id)
+	}
+	return key, nil
+}
+
+// IDs lists IDs of all keys in the keyring
+func (k *Keyring) IDs() []uint32 {
+	var ids []uint32
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (k *Keyring) check() error {
+	if k == nil || len(k.keys) == 0 {
+		return errors.Wrap(ErrBadKey, "empty keyring")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package cellar
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+func newKeyring(t *testing.T, keys map[uint32][]byte, current uint32) *Keyring {
+	kr := NewKeyring()
+	for id, key := range keys {
+		assert(t, kr.Add(id, key), "Add")
+	}
+	assert(t, kr.SetCurrent(current), "SetCurrent")
+	return kr
+}
+
+func listChunks(t *testing.T, folder string, keys *Keyring) []*ChunkDto {
+	var chunks []*ChunkDto
+	err := NewReaderWithKeyring(folder, keys).ReadDB(func(tx *mdb.Tx) error {
+		var err error
+		chunks, err = lmdbListChunks(tx)
+		return err
+	})
+	assert(t, err, "lmdbListChunks")
+	return chunks
+}
+
+func assertKeyringRecords(t *testing.T, folder string, keys *Keyring, count int) {
+	var n int
+	err := NewReaderWithKeyring(folder, keys).Scan(func(pos *ReaderInfo, s []byte) error {
+		if err := checkSeedBytes(s, n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+		return nil
+	})
+	assert(t, err, "Scan")
+	if n != count {
+		t.Fatalf("Expected %d records but got %d", count, n)
+	}
+}
+
+// assertFiles makes sure that the folder contains only the files
+// of the registered chunks, the buffer and the metadata DB
+func assertFiles(t *testing.T, folder string, chunks []*ChunkDto) {
+	expected := map[string]bool{"data.mdb": true, "lock.mdb": true, lockFileName: true}
+	for _, c := range chunks {
+		expected[c.FileName] = true
+	}
+	files, err := ioutil.ReadDir(folder)
+	assert(t, err, "ReadDir")
+	for _, f := range files {
+		if !expected[f.Name()] && !bufferFileRe.MatchString(f.Name()) {
+			t.Fatalf("Unexpected file %s", f.Name())
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	folder := getFolder()
+	oldKey, newKey := genRandBytes(16), genRandBytes(32)
+
+	w, err := NewWriter(folder, 1000, oldKey)
+	assert(t, err, "NewWriter")
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+	closeWriter(t, w)
+
+	both := newKeyring(t, map[uint32][]byte{0: oldKey, 7: newKey}, 7)
+
+	w, err = NewWriterWithKeyring(folder, 1000, both)
+	assert(t, err, "NewWriterWithKeyring")
+	for i := 40; i < 80; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+	defer closeWriter(t, w)
+
+	var old, rotated int
+	for _, c := range listChunks(t, folder, both) {
+		if c.KeyId == 7 {
+			rotated++
+		} else {
+			old++
+		}
+	}
+	if old == 0 || rotated == 0 {
+		t.Fatalf("Expected chunks with both keys, got %d old and %d new", old, rotated)
+	}
+
+	assertKeyringRecords(t, folder, both, 80)
+
+	onlyNew := newKeyring(t, map[uint32][]byte{7: newKey}, 7)
+
+	reader := NewReaderWithKeyring(folder, onlyNew)
+	if err = reader.Scan(func(*ReaderInfo, []byte) error { return nil }); errors.Cause(err) != ErrUnknownKey {
+		t.Fatalf("Expected ErrUnknownKey but got %v", err)
+	}
+
+	// interrupt the rotation after the first chunk is written
+	restore := crashAt(crashRotateWritten)
+	err = w.RotateKeys(nil)
+	restore()
+	if errors.Cause(err) != errCrash {
+		t.Fatalf("Expected crash but got %v", err)
+	}
+
+	var done, total int
+	assert(t, w.RotateKeys(func(d, tt int) { done, total = d, tt }), "RotateKeys")
+
+	if done != old || total != old {
+		t.Fatalf("Expected progress %d of %d but got %d of %d", old, old, done, total)
+	}
+
+	chunks := listChunks(t, folder, onlyNew)
+	for _, c := range chunks {
+		if c.KeyId != 7 || c.FormatVersion != chunkFormatGCM {
+			t.Fatalf("Chunk %s was not rotated", c.FileName)
+		}
+	}
+	assertFiles(t, folder, chunks)
+
+	assertKeyringRecords(t, folder, onlyNew, 80)
+
+	// nothing left to rotate
+	done = 0
+	assert(t, w.RotateKeys(func(d, tt int) { done = d }), "RotateKeys")
+	if done != 0 {
+		t.Fatalf("Expected nothing to rotate but got %d", done)
+	}
+}
@@ -3,7 +3,6 @@ package cellar
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
 
 	"github.com/abdullin/lex-go/tuple"
 	"github.com/abdullin/mdb"
@@ -46,17 +45,74 @@ func lmdbGetUserCheckpoint(tx *mdb.Tx, name string) (int64, error) {
 	return int64(binary.LittleEndian.Uint64(value)), nil
 }
 
-func lmdbAddChunk(tx *mdb.Tx, chunkStartPos int64, dto *ChunkDto) error {
+func lmdbListUserCheckpoints(tx *mdb.Tx) (map[string]int64, error) {
+
+	tpl := mdb.CreateKey(UserCheckpointTable)
+
+	scanner := lmdbscan.New(tx.Tx, tx.DB)
+
+	defer scanner.Close()
+	scanner.Set(tpl, nil, lmdb.SetRange)
+
+	checkpoints := make(map[string]int64)
+
+	for scanner.Scan() {
+		key := scanner.Key()
+
+		if !bytes.HasPrefix(key, tpl) {
+			break
+		}
+
+		t, err := tuple.Unpack(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unpack %x", key)
+		}
+		name, ok := t[len(t)-1].(string)
+		if !ok {
+			return nil, errors.Errorf("Unexpected checkpoint key %x", key)
+		}
+		checkpoints[name] = int64(binary.LittleEndian.Uint64(scanner.Val()))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Scanner.Scan")
+	}
+	return checkpoints, nil
+}
+
+func lmdbPutChunk(tx *mdb.Tx, chunkStartPos int64, dto *ChunkDto) error {
 	key := mdb.CreateKey(ChunkTable, chunkStartPos)
 
 	if err := tx.PutProto(key, dto); err != nil {
 		return errors.Wrap(err, "PutProto")
 	}
-
-	log.Printf("Added chunk %s with %d records and %d bytes (%d compressed)", dto.FileName, dto.Records, dto.UncompressedByteSize, dto.CompressedDiskSize)
 	return nil
 }
 
+func lmdbDelChunk(tx *mdb.Tx, chunkStartPos int64) error {
+	key := mdb.CreateKey(ChunkTable, chunkStartPos)
+	return tx.Del(key)
+}
+
+func lmdbGetChunk(tx *mdb.Tx, chunkStartPos int64) (*ChunkDto, error) {
+	key := mdb.CreateKey(ChunkTable, chunkStartPos)
+
+	var data []byte
+	var err error
+
+	if data, err = tx.Get(key); err != nil {
+		return nil, errors.Wrap(err, "tx.Get")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	dto := &ChunkDto{}
+	if err = proto.Unmarshal(data, dto); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
+	}
+	return dto, nil
+}
+
 func lmdbListChunks(tx *mdb.Tx) ([]*ChunkDto, error) {
 
 	tpl := mdb.CreateKey(ChunkTable)
@@ -140,7 +196,7 @@ func lmdbIndexPosition(tx *mdb.Tx, stream string, k uint64, pos int64) error {
 	return nil
 }
 
-func lmdbLookupPosition(tx *mdb.Tx, stream string, k uint64) (int64, error) {
+func lmdbLookupPosition(tx *mdb.Tx, stream string, k uint64) (int64, bool, error) {
 
 	tpl := tuple.Tuple([]tuple.Element{MetaTable, stream, k})
 	key := tpl.Pack()
@@ -148,12 +204,58 @@ func lmdbLookupPosition(tx *mdb.Tx, stream string, k uint64) (int64, error) {
 
 	var val []byte
 	if val, err = tx.Get(key); err != nil {
-		return 0, errors.Wrap(err, "tx.Get")
+		return 0, false, errors.Wrap(err, "tx.Get")
+	}
+	if val == nil {
+		return 0, false, nil
 	}
 	var pos int64
 
 	pos, _ = binary.Varint(val)
-	return pos, nil
+	return pos, true, nil
+}
+
+// lmdbScanIndex passes index entries of the stream with keys in [from, to)
+// to the op in the key order
+func lmdbScanIndex(tx *mdb.Tx, stream string, from, to uint64, op func(k uint64, pos int64) error) error {
+
+	prefix := tuple.Tuple([]tuple.Element{MetaTable, stream}).Pack()
+	start := tuple.Tuple([]tuple.Element{MetaTable, stream, from}).Pack()
+
+	scanner := lmdbscan.New(tx.Tx, tx.DB)
+
+	defer scanner.Close()
+	scanner.Set(start, nil, lmdb.SetRange)
+
+	for scanner.Scan() {
+		key := scanner.Key()
+
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+
+		tpl, err := tuple.Unpack(key)
+		if err != nil {
+			return errors.Wrapf(err, "Unpack %x", key)
+		}
+		k, ok := tpl[len(tpl)-1].(int64)
+		if !ok {
+			return errors.Errorf("Unexpected index key %x", key)
+		}
+		if uint64(k) >= to {
+			break
+		}
+
+		pos, _ := binary.Varint(scanner.Val())
+		if err = op(uint64(k), pos); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "Scanner.Scan")
+	}
+	return nil
 }
 
 func lmdbSetCellarMeta(tx *mdb.Tx, m *MetaDto) error {
@@ -164,11 +266,19 @@ func lmdbSetCellarMeta(tx *mdb.Tx, m *MetaDto) error {
 func lmdbGetCellarMeta(tx *mdb.Tx) (*MetaDto, error) {
 
 	key := mdb.CreateKey(CellarTable)
-	dto := &MetaDto{}
+
+	var data []byte
 	var err error
 
-	if err = tx.ReadProto(key, dto); err != nil {
-		return nil, errors.Wrap(err, "ReadProto")
+	if data, err = tx.Get(key); err != nil {
+		return nil, errors.Wrap(err, "tx.Get")
+	}
+	if data == nil {
+		return nil, nil
+	}
+	dto := &MetaDto{}
+	if err = proto.Unmarshal(data, dto); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
 	}
 	return dto, nil
 
@@ -0,0 +1,236 @@
+package cellar
+
+import (
+	"path"
+	"sync"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// fileLoader reads the files listed in a metadata snapshot. The writer
+// keeps moving files after the snapshot is taken: the sealed buffer
+// becomes the chunk with the same start position and key rotation
+// renames the chunks. Instead of failing on a vanished file, loader
+// looks it up in the current index and reads it from the new place.
+// Chunks dropped by the truncation fail with ErrTruncated.
+type fileLoader struct {
+	folder string
+	keys   *Keyring
+	// db is used for the lookups if set, otherwise
+	// the DB is opened for each lookup
+	db *mdb.DB
+	// buf, if set, receives the loaded data instead of the new
+	// allocations. Data is valid only till the next load then
+	buf []byte
+}
+
+// chunkBuffers hold the buffers of the whole-chunk scans,
+// so repeated scans reuse the memory
+var chunkBuffers sync.Pool
+
+// getChunkBuffer returns the pooled buffer that fits the size,
+// put it back into chunkBuffers once the data is not used
+func getChunkBuffer(size int64) *[]byte {
+	if b, ok := chunkBuffers.Get().(*[]byte); ok && int64(cap(*b)) >= size {
+		return b
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// alloc returns the slice for the data of the size
+func (l *fileLoader) alloc(size int64) []byte {
+	if int64(cap(l.buf)) >= size {
+		return l.buf[:size]
+	}
+	return make([]byte, size)
+}
+
+func (r *Reader) loader(keys *Keyring) *fileLoader {
+	return &fileLoader{folder: r.Folder, keys: keys}
+}
+
+// lookup returns the current index entry of the chunk starting at
+// the position, nil if there is none. Chunks before the low-water
+// mark were truncated
+func (l *fileLoader) lookup(startPos int64) (*ChunkDto, error) {
+
+	db := l.db
+	if db == nil {
+		var err error
+		if db, err = mdb.New(l.folder, mdb.NewConfig()); err != nil {
+			return nil, errors.Wrap(err, "mdb.New")
+		}
+		defer db.Close()
+	}
+
+	var c *ChunkDto
+	var meta *MetaDto
+	err := db.Read(func(tx *mdb.Tx) error {
+		var err error
+		if c, err = lmdbGetChunk(tx, startPos); err != nil {
+			return errors.Wrap(err, "lmdbGetChunk")
+		}
+		if meta, err = lmdbGetCellarMeta(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetCellarMeta")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "db.Read")
+	}
+	if c == nil && meta != nil && startPos < meta.LowWaterMark {
+		return nil, errors.Wrapf(ErrTruncated, "%d is before %d", startPos, meta.LowWaterMark)
+	}
+	return c, nil
+}
+
+// moved returns the new entry of the missing chunk,
+// nil if the chunk wasn't renamed
+func (l *fileLoader) moved(c *ChunkDto) (*ChunkDto, error) {
+	n, err := l.lookup(c.StartPos)
+	if err != nil || n == nil || n.FileName == c.FileName {
+		return nil, err
+	}
+	return n, nil
+}
+
+// sealed returns the chunk that replaced the missing buffer,
+// nil if the buffer wasn't sealed
+func (l *fileLoader) sealed(b *BufferDto) (*ChunkDto, error) {
+	c, err := l.lookup(b.StartPos)
+	if err != nil || c == nil || c.UncompressedByteSize < b.Pos {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (l *fileLoader) loadChunk(c *ChunkDto) ([]byte, error) {
+
+	var err error
+
+	data := l.alloc(c.UncompressedByteSize)
+	if data, err = loadChunkIntoBuffer(path.Join(l.folder, c.FileName), l.keys, c, data); err != nil {
+		return nil, err
+	}
+	if err = checkChunkChecksum(c, data); err != nil {
+		return nil, errors.Wrap(err, "checkChunkChecksum")
+	}
+	return data, nil
+}
+
+// chunk loads the whole chunk and verifies its checksum
+func (l *fileLoader) chunk(c *ChunkDto) ([]byte, error) {
+
+	data, err := l.loadChunk(c)
+	if errors.Cause(err) != ErrChunkMissing {
+		return data, err
+	}
+
+	n, lerr := l.moved(c)
+	if lerr != nil {
+		return nil, errors.Wrapf(lerr, "lookup after %s", err)
+	}
+	if n == nil {
+		return nil, err
+	}
+	return l.loadChunk(n)
+}
+
+// buffer loads the checkpointed part of the buffer
+func (l *fileLoader) buffer(b *BufferDto) ([]byte, error) {
+
+	data, err := loadBufferFile(path.Join(l.folder, b.FileName), l.alloc(b.Pos))
+	if errors.Cause(err) != ErrBufferMissing {
+		return data, err
+	}
+
+	c, lerr := l.sealed(b)
+	if lerr != nil {
+		return nil, errors.Wrapf(lerr, "lookup after %s", err)
+	}
+	if c == nil {
+		return nil, err
+	}
+
+	// the chunk could have records added after the snapshot
+	if data, err = l.chunk(c); err != nil {
+		return nil, errors.Wrapf(err, "sealed chunk %s", c.FileName)
+	}
+	return data[:b.Pos], nil
+}
+
+// streamChunk replays the chunk without loading it into memory.
+// Missing file is detected before any record is delivered, so
+// the renamed chunk could be streamed from the start
+func (l *fileLoader) streamChunk(c *ChunkDto, info *ReaderInfo, op ReadOp, offset int64) error {
+
+	err := streamChunk(path.Join(l.folder, c.FileName), l.keys, c, info, op, offset)
+	if errors.Cause(err) != ErrChunkMissing {
+		return err
+	}
+
+	n, lerr := l.moved(c)
+	if lerr != nil {
+		return errors.Wrapf(lerr, "lookup after %s", err)
+	}
+	if n == nil {
+		return err
+	}
+	return streamChunk(path.Join(l.folder, n.FileName), l.keys, n, info, op, offset)
+}
+
+// streamBuffer replays the checkpointed part of the buffer. Sealed
+// buffer is replayed from its chunk, which is not larger than the
+// buffer itself
+func (l *fileLoader) streamBuffer(b *BufferDto, info *ReaderInfo, op ReadOp, offset int64) error {
+
+	err := streamBuffer(path.Join(l.folder, b.FileName), b, info, op, offset)
+	if errors.Cause(err) != ErrBufferMissing {
+		return err
+	}
+
+	var data []byte
+	if data, err = l.buffer(b); err != nil {
+		return err
+	}
+	info.ChunkPos = b.StartPos
+	return replayChunk(info, data, op, int(offset), b.RecordChecksums)
+}
+
+// readChunk reads a single record at the global position
+func (l *fileLoader) readChunk(c *ChunkDto, pos int64) ([]byte, *ReaderInfo, error) {
+
+	data, info, err := readChunkRecord(path.Join(l.folder, c.FileName), l.keys, c, pos)
+	if errors.Cause(err) != ErrChunkMissing {
+		return data, info, err
+	}
+
+	n, lerr := l.moved(c)
+	if lerr != nil {
+		return nil, nil, errors.Wrapf(lerr, "lookup after %s", err)
+	}
+	if n == nil {
+		return nil, nil, err
+	}
+	return readChunkRecord(path.Join(l.folder, n.FileName), l.keys, n, pos)
+}
+
+// readBuffer reads a single record of the buffer at the global position
+func (l *fileLoader) readBuffer(b *BufferDto, pos int64) ([]byte, *ReaderInfo, error) {
+
+	data, info, err := readBufferRecord(path.Join(l.folder, b.FileName), b, pos)
+	if errors.Cause(err) != ErrBufferMissing {
+		return data, info, err
+	}
+
+	c, lerr := l.sealed(b)
+	if lerr != nil {
+		return nil, nil, errors.Wrapf(lerr, "lookup after %s", err)
+	}
+	if c == nil {
+		return nil, nil, err
+	}
+	return l.readChunk(c, pos)
+}
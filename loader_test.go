@@ -0,0 +1,91 @@
+package cellar
+
+import (
+	"io"
+	"testing"
+)
+
+func TestReadSealedBuffer(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	var positions []int64
+	for i := 0; i < 20; i++ {
+		positions = append(positions, w.VolatilePos())
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+
+	it := NewReader(folder, key).Iterate()
+	if !it.Next() {
+		t.Fatalf("Expected the first record: %v", it.Err())
+	}
+
+	// records past the snapshot end up in the sealed chunk too
+	_, err = w.Append(genSeedBytes(64, 20))
+	assert(t, err, "Append")
+	assert(t, w.SealTheBuffer(), "SealTheBuffer")
+
+	n := 1
+	for it.Next() {
+		if err = checkSeedBytes(it.Record(), n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+	}
+	assert(t, it.Err(), "Err")
+	if n != 20 {
+		t.Fatalf("Expected 20 records from the snapshot but got %d", n)
+	}
+
+	// position from the stale snapshot of the buffer
+	_, err = it.Seek(positions[5], io.SeekStart)
+	assert(t, err, "Seek")
+	if !it.Next() || checkSeedBytes(it.Record(), 5) != nil {
+		t.Fatalf("Expected record 5 after seek: %v", it.Err())
+	}
+}
+
+func TestReadRotatedChunk(t *testing.T) {
+	folder := getFolder()
+	oldKey, newKey := genRandBytes(16), genRandBytes(32)
+
+	w, err := NewWriter(folder, 1000, oldKey)
+	assert(t, err, "NewWriter")
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+	closeWriter(t, w)
+
+	both := newKeyring(t, map[uint32][]byte{0: oldKey, 7: newKey}, 7)
+
+	w, err = NewWriterWithKeyring(folder, 1000, both)
+	assert(t, err, "NewWriterWithKeyring")
+	defer closeWriter(t, w)
+
+	// every chunk is renamed after the snapshot is taken
+	it := NewReaderWithKeyring(folder, both).Iterate()
+	if !it.Next() {
+		t.Fatalf("Expected the first record: %v", it.Err())
+	}
+	assert(t, w.RotateKeys(nil), "RotateKeys")
+
+	n := 1
+	for it.Next() {
+		if err = checkSeedBytes(it.Record(), n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+	}
+	assert(t, it.Err(), "Err")
+	if n != 40 {
+		t.Fatalf("Expected 40 records but got %d", n)
+	}
+}
@@ -0,0 +1,62 @@
+package cellar
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// lockFileName is the file locked by the writer for its lifetime.
+// The lock is held by the OS, so it goes away with a crashed process
+const lockFileName = "writer.lock"
+
+// folderLock is the exclusive lock of the writer over the folder
+type folderLock struct {
+	file *os.File
+}
+
+// lockFolder acquires the writer lock or fails with ErrLocked
+func lockFolder(folder string) (*folderLock, error) {
+
+	loc := path.Join(folder, lockFileName)
+
+	f, err := openLocked(loc)
+	if err != nil {
+		if errors.Cause(err) == ErrLocked {
+			owner, _ := ioutil.ReadFile(loc)
+			return nil, errors.Wrapf(ErrLocked, "%s is held by %s", loc, describeOwner(owner))
+		}
+		return nil, errors.Wrap(err, "openLocked")
+	}
+
+	// leave a note for the error message of the next writer
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("pid %d", os.Getpid())), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "write owner")
+	}
+	return &folderLock{f}, nil
+}
+
+func describeOwner(owner []byte) string {
+	if s := strings.TrimSpace(string(owner)); s != "" {
+		return s
+	}
+	return "another writer"
+}
+
+// release unlocks the folder, it is safe to call it more than once
+func (l *folderLock) release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,36 @@
+package cellar
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestWriterLock(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	if _, err = NewWriter(folder, 1000, key); errors.Cause(err) != ErrLocked {
+		t.Fatalf("Expected ErrLocked but got %v", err)
+	}
+	if err = RotateKeys(folder, w.keys, nil); errors.Cause(err) != ErrLocked {
+		t.Fatalf("Expected ErrLocked from RotateKeys but got %v", err)
+	}
+
+	// readers don't need the lock
+	_, err = w.Append(genSeedBytes(64, 0))
+	assert(t, err, "Append")
+	assertCheckpoint(t, w)
+	assertRecords(t, folder, key, 1)
+
+	closeWriter(t, w)
+	// second close is harmless
+	assert(t, w.lock.release(), "release")
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter after Close")
+	closeWriter(t, w)
+}
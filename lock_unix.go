@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package cellar
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// openLocked opens the file, holding the exclusive flock on it.
+// Locks belong to the open file, so the second writer in the same
+// process conflicts as well
+func openLocked(loc string) (*os.File, error) {
+
+	f, err := os.OpenFile(loc, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenFile")
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrap(err, "Flock")
+	}
+	return f, nil
+}
@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+package cellar
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const errorSharingViolation syscall.Errno = 32
+
+// openLocked opens the file without sharing it, so that
+// nobody else can open it until the handle is closed
+func openLocked(loc string) (*os.File, error) {
+
+	name, err := syscall.UTF16PtrFromString(loc)
+	if err != nil {
+		return nil, errors.Wrap(err, "UTF16PtrFromString")
+	}
+
+	h, err := syscall.CreateFile(name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, ErrLocked
+		}
+		return nil, errors.Wrap(err, "CreateFile")
+	}
+	return os.NewFile(uintptr(h), loc), nil
+}
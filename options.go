@@ -0,0 +1,161 @@
+package cellar
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// Logger receives the diagnostic messages of the writer.
+// *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger sends the messages to the standard logger
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// Hooks are called by the writer after the changes are committed.
+// They run synchronously, so they should be quick
+type Hooks struct {
+	// OnSeal is called after the buffer was sealed into the chunk
+	OnSeal func(c *ChunkDto)
+	// OnCheckpoint is called with the position of the checkpoint
+	OnCheckpoint func(pos int64)
+	// OnRecovery is called if the folder had to be repaired on open
+	OnRecovery func(r *RecoveryReport)
+	// OnTruncate is called with the new low-water mark after
+	// the chunks were dropped
+	OnTruncate func(lowWaterMark int64)
+	// OnRetentionError is called if the retention policy failed after
+	// the seal. The seal and the append that caused it still succeed
+	OnRetentionError func(err error)
+}
+
+// Options configure the writer. Options are persisted in the metadata
+// DB, zero values are taken from the previous run when the store is
+// reopened, falling back to the defaults for the new stores.
+type Options struct {
+	// BufferSize is the max size of the buffer and of the chunks
+	BufferSize int64
+	// Key encrypts the chunks, ignored if Keys is set
+	Key []byte
+	// Keys encrypts the chunks with the current key of the keyring
+	Keys *Keyring
+	// Codec compresses the chunks, LZ4 by default
+	Codec Codec
+	// Level of the codec, 0 picks the default of the codec
+	Level int
+	// RecordChecksums stores CRC-32C after every record. Once enabled,
+	// it stays on for the store
+	RecordChecksums bool
+	// MapSizeMbs is the size of the LMDB memory map, 1024 by default
+	MapSizeMbs int64
+	// DBFlags are LMDB environment flags like lmdb.NoMetaSync that
+	// trade durability for speed. Writes are fully synchronous by default.
+	// Flags are not taken from the previous run, pass them on every open
+	DBFlags uint
+	// Logger receives the diagnostic messages, standard logger by default
+	Logger Logger
+	Hooks  Hooks
+	// Retention, if set, is applied after each seal of the buffer.
+	// It is not persisted
+	Retention RetentionPolicy
+	// RejectLargeRecords makes Append fail with ErrRecordTooLarge on
+	// the records that don't fit into the buffer, instead of storing
+	// them in their own chunks. It is not persisted
+	RejectLargeRecords bool
+}
+
+const defaultMapSizeMbs = 1024
+
+// keyring resolves the encryption keys of the options
+func (o *Options) keyring() (*Keyring, error) {
+	if o.Keys != nil {
+		return o.Keys, o.Keys.check()
+	}
+	return singleKey(o.Key)
+}
+
+// inherit fills zero options with the values persisted by the
+// previous run and makes sure that the rest matches the store
+func (o *Options) inherit(meta *MetaDto, keys *Keyring) error {
+	if meta == nil {
+		return nil
+	}
+	if o.BufferSize == 0 {
+		o.BufferSize = meta.BufferSize
+	}
+	if o.Codec == nil {
+		codec, err := CodecByID(meta.Codec)
+		if err != nil {
+			return errors.Wrap(err, "stored codec")
+		}
+		o.Codec = codec
+		if o.Level == 0 {
+			o.Level = int(meta.Level)
+		}
+	}
+	o.RecordChecksums = o.RecordChecksums || meta.RecordChecksums
+	if o.MapSizeMbs == 0 {
+		o.MapSizeMbs = meta.MapSizeMbs
+	}
+
+	if len(meta.KeyCheck) > 0 {
+		// keys that are not in the keyring can't be checked
+		if key, err := keys.Key(meta.KeyId); err == nil && !bytes.Equal(keyCheck(key), meta.KeyCheck) {
+			return errors.Wrapf(ErrBadKey, "key %d doesn't match the store", meta.KeyId)
+		}
+	}
+	return nil
+}
+
+// check validates the options, filling in the defaults
+func (o *Options) check() error {
+	if o.BufferSize <= 0 {
+		return errors.Wrapf(ErrInvalidOptions, "buffer size %d", o.BufferSize)
+	}
+	if o.Codec == nil {
+		o.Codec = CodecLZ4
+	}
+	if err := checkCodec(o.Codec, o.Level); err != nil {
+		return errors.Wrap(ErrInvalidOptions, err.Error())
+	}
+	if o.MapSizeMbs == 0 {
+		o.MapSizeMbs = defaultMapSizeMbs
+	}
+	if o.MapSizeMbs < 0 {
+		return errors.Wrapf(ErrInvalidOptions, "map size %d", o.MapSizeMbs)
+	}
+	if o.Logger == nil {
+		o.Logger = stdLogger{}
+	}
+	return nil
+}
+
+// applyDB configures the LMDB environment opened before
+// the persisted options were known
+func (o *Options) applyDB(db *mdb.DB, cfg *mdb.Config) error {
+	if o.MapSizeMbs > cfg.SizeMbs {
+		if err := db.Env.SetMapSize(o.MapSizeMbs * 1024 * 1024); err != nil {
+			return errors.Wrap(err, "SetMapSize")
+		}
+	}
+	return nil
+}
+
+// keyCheck derives a value that tells if the key is the same
+// without revealing it
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("cellar key check"))
+	return mac.Sum(nil)[:8]
+}
@@ -0,0 +1,139 @@
+package cellar
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/pkg/errors"
+)
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestOptionsArePersisted(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriterWithOptions(folder, Options{
+		BufferSize:      1000,
+		Key:             key,
+		Codec:           CodecZstd,
+		Level:           3,
+		RecordChecksums: true,
+		MapSizeMbs:      2048,
+	})
+	assert(t, err, "NewWriterWithOptions")
+	closeWriter(t, w)
+
+	// zero options are taken from the store
+	w, err = NewWriter(folder, 0, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	if w.maxBufferSize != 1000 || w.codec != CodecZstd || w.level != 3 || w.mapSizeMbs != 2048 {
+		t.Fatalf("Options were not restored: %d %s %d %d", w.maxBufferSize, w.codec.Name(), w.level, w.mapSizeMbs)
+	}
+
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+	for _, c := range listChunks(t, folder, keys) {
+		if c.Codec != CodecZstd.ID() || !c.RecordChecksums {
+			t.Fatalf("Chunk %s doesn't use the stored options", c.FileName)
+		}
+	}
+	assertRecords(t, folder, key, 40)
+}
+
+func TestDBFlagsAreNotInherited(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriterWithOptions(folder, Options{
+		BufferSize: 1000,
+		Key:        key,
+		DBFlags:    lmdb.NoSync | lmdb.NoMetaSync,
+	})
+	assert(t, err, "NewWriterWithOptions")
+	closeWriter(t, w)
+
+	// reopened store is back to the synchronous writes
+	w, err = NewWriter(folder, 0, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	flags, err := w.db.Env.Flags()
+	assert(t, err, "Flags")
+	if flags&(lmdb.NoSync|lmdb.NoMetaSync) != 0 {
+		t.Fatalf("Expected synchronous writes, got flags %x", flags)
+	}
+}
+
+func TestOptionsValidation(t *testing.T) {
+
+	key := genRandBytes(16)
+
+	if _, err := NewWriterWithOptions(getFolder(), Options{Key: key}); errors.Cause(err) != ErrInvalidOptions {
+		t.Fatalf("Expected ErrInvalidOptions for missing buffer size but got %v", err)
+	}
+
+	opts := Options{BufferSize: 1000, Key: key, Codec: CodecGzip, Level: 42}
+	if _, err := NewWriterWithOptions(getFolder(), opts); errors.Cause(err) != ErrInvalidOptions {
+		t.Fatalf("Expected ErrInvalidOptions for bad level but got %v", err)
+	}
+
+	folder := getFolder()
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	closeWriter(t, w)
+
+	if _, err = NewWriter(folder, 1000, genRandBytes(16)); errors.Cause(err) != ErrBadKey {
+		t.Fatalf("Expected ErrBadKey for the wrong key but got %v", err)
+	}
+}
+
+func TestLoggerAndHooks(t *testing.T) {
+
+	logger := &testLogger{}
+	var sealed []*ChunkDto
+	var checkpoints []int64
+
+	w, err := NewWriterWithOptions(getFolder(), Options{
+		BufferSize: 1000,
+		Key:        genRandBytes(16),
+		Logger:     logger,
+		Hooks: Hooks{
+			OnSeal:       func(c *ChunkDto) { sealed = append(sealed, c) },
+			OnCheckpoint: func(pos int64) { checkpoints = append(checkpoints, pos) },
+		},
+	})
+	assert(t, err, "NewWriterWithOptions")
+	defer closeWriter(t, w)
+
+	for i := 0; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	pos, err := w.Checkpoint()
+	assert(t, err, "Checkpoint")
+
+	if len(sealed) == 0 || len(logger.lines) < len(sealed) {
+		t.Fatalf("Expected seals to be reported, got %d seals and %d log lines", len(sealed), len(logger.lines))
+	}
+	if len(checkpoints) != 1 || checkpoints[0] != pos {
+		t.Fatalf("Expected checkpoint at %d but got %v", pos, checkpoints)
+	}
+}
@@ -0,0 +1,245 @@
+package cellar
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ScanParallel is Scan that decodes chunks ahead in the worker
+// goroutines, while the op is still called sequentially with the
+// records in their original order. At most `workers` decoded chunks
+// are held in memory, 0 picks the number of CPUs.
+func (r *Reader) ScanParallel(ctx context.Context, workers int, op ReadOp) error {
+
+	b, chunks, keys, err := r.prepareParallel()
+	if err != nil {
+		return err
+	}
+	workers = workerCount(workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	defer func() {
+		// stop decoding ahead and wait for the workers
+		cancel()
+		wg.Wait()
+	}()
+
+	type decoded struct {
+		data []byte
+		err  error
+	}
+
+	// every chunk gets its own slot, so the results could be
+	// delivered in order. Slots are buffered, workers never block
+	results := make([]chan decoded, len(chunks))
+	for i := range results {
+		results[i] = make(chan decoded, 1)
+	}
+
+	// limits the number of decoded chunks in memory
+	sem := make(chan struct{}, workers)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, c := range chunks {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(i int, c *ChunkDto) {
+				defer wg.Done()
+				data, err := r.decodeChunk(keys, c)
+				results[i] <- decoded{data, err}
+			}(i, c)
+		}
+	}()
+
+	info := &ReaderInfo{}
+
+	for i, c := range chunks {
+		var res decoded
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+
+		info.ChunkPos = c.StartPos
+		if err = replayChunk(info, res.data, contextOp(ctx, op), r.offsetIn(c.StartPos), c.RecordChecksums); err != nil {
+			return errors.Wrap(err, "Failed to read chunk")
+		}
+		// chunk is delivered, let the next one decode
+		<-sem
+	}
+
+	return r.replayBuffer(ctx, keys, b, info, op)
+}
+
+// ScanUnordered calls the op concurrently from the worker goroutines,
+// one chunk per worker. Records of a single chunk are delivered in
+// order, but the chunks (and the buffer) are processed in any order.
+// This suits aggregations that don't care about the order. At most
+// `workers` decoded chunks are held in memory, 0 picks the number
+// of CPUs.
+func (r *Reader) ScanUnordered(ctx context.Context, workers int, op ReadOp) error {
+
+	b, chunks, keys, err := r.prepareParallel()
+	if err != nil {
+		return err
+	}
+	workers = workerCount(workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the buffer is the last job
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failure error
+
+	fail := func(err error) {
+		once.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info := &ReaderInfo{}
+			for i := range jobs {
+				if err := r.replayJob(ctx, keys, chunks, b, i, info, op); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i <= len(chunks); i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failure != nil {
+		return failure
+	}
+	return ctx.Err()
+}
+
+func (r *Reader) replayJob(ctx context.Context, keys *Keyring, chunks []*ChunkDto, b *BufferDto, i int, info *ReaderInfo, op ReadOp) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if i == len(chunks) {
+		return r.replayBuffer(ctx, keys, b, info, op)
+	}
+
+	c := chunks[i]
+	data, err := r.decodeChunk(keys, c)
+	if err != nil {
+		return err
+	}
+	info.ChunkPos = c.StartPos
+	if err = replayChunk(info, data, contextOp(ctx, op), r.offsetIn(c.StartPos), c.RecordChecksums); err != nil {
+		return errors.Wrap(err, "Failed to read chunk")
+	}
+	return nil
+}
+
+// prepareParallel lists the chunks that contain records past the
+// StartPos of the reader
+func (r *Reader) prepareParallel() (*BufferDto, []*ChunkDto, *Keyring, error) {
+
+	keys, err := r.keyring()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	b, chunks, err := r.loadState()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	i := sort.Search(len(chunks), func(i int) bool {
+		c := chunks[i]
+		return c.StartPos+c.UncompressedByteSize > r.StartPos
+	})
+	return b, chunks[i:], keys, nil
+}
+
+func (r *Reader) decodeChunk(keys *Keyring, c *ChunkDto) ([]byte, error) {
+
+	data, err := r.loader(keys).chunk(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to load chunk %s", c.FileName)
+	}
+	return data, nil
+}
+
+func (r *Reader) replayBuffer(ctx context.Context, keys *Keyring, b *BufferDto, info *ReaderInfo, op ReadOp) error {
+
+	if b == nil || b.Pos == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := r.loader(keys).buffer(b)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to load buffer %s", b.FileName)
+	}
+
+	info.ChunkPos = b.StartPos
+	if err = replayChunk(info, data, contextOp(ctx, op), r.offsetIn(b.StartPos), b.RecordChecksums); err != nil {
+		return errors.Wrap(err, "Failed to read chunk")
+	}
+	return nil
+}
+
+// offsetIn returns where the reader starts within the chunk
+func (r *Reader) offsetIn(chunkPos int64) int {
+	if r.StartPos > chunkPos {
+		return int(r.StartPos - chunkPos)
+	}
+	return 0
+}
+
+// contextOp stops the op once the context is cancelled
+func contextOp(ctx context.Context, op ReadOp) ReadOp {
+	return func(info *ReaderInfo, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return op(info, data)
+	}
+}
+
+func workerCount(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
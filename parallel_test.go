@@ -0,0 +1,136 @@
+package cellar
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestScanParallel(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+	writeChecksummed(t, folder, key, 100)
+
+	expected := scanInfos(t, NewReader(folder, key))
+
+	for _, workers := range []int{0, 1, 3} {
+		var n int
+		err := NewReader(folder, key).ScanParallel(context.Background(), workers, func(ri *ReaderInfo, data []byte) error {
+			if err := checkSeedBytes(data, n); err != nil {
+				t.Fatalf("Failed seed check: %s", err)
+			}
+			if *ri != expected[n] {
+				t.Fatalf("Expected %v but got %v", expected[n], *ri)
+			}
+			n++
+			return nil
+		})
+		assert(t, err, "ScanParallel")
+		if n != len(expected) {
+			t.Fatalf("Expected %d records with %d workers but got %d", len(expected), workers, n)
+		}
+	}
+
+	// start in the middle of a chunk
+	reader := NewReader(folder, key)
+	reader.StartPos = expected[30].StartPos
+	n := 30
+	err := reader.ScanParallel(context.Background(), 2, func(ri *ReaderInfo, data []byte) error {
+		if err := checkSeedBytes(data, n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+		return nil
+	})
+	assert(t, err, "ScanParallel")
+	if n != 100 {
+		t.Fatalf("Expected to reach 100 records but got %d", n)
+	}
+}
+
+func TestScanUnordered(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+	recs := writeChecksummed(t, folder, key, 100)
+
+	seeds := make(map[int64]int)
+	for _, r := range recs {
+		seeds[r.pos] = r.seed
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+
+	err := NewReader(folder, key).ScanUnordered(context.Background(), 4, func(ri *ReaderInfo, data []byte) error {
+		if err := checkSeedBytes(data, seeds[ri.StartPos]); err != nil {
+			t.Errorf("Failed seed check at %d: %s", ri.StartPos, err)
+		}
+		mu.Lock()
+		seen[ri.StartPos] = true
+		mu.Unlock()
+		return nil
+	})
+	assert(t, err, "ScanUnordered")
+	if len(seen) != len(recs) {
+		t.Fatalf("Expected %d records but got %d", len(recs), len(seen))
+	}
+}
+
+func TestParallelScanFailures(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	assert(t, os.Remove(path.Join(folder, chunks[1].FileName)), "Remove")
+
+	var n int
+	err := NewReader(folder, key).ScanParallel(context.Background(), 2, func(*ReaderInfo, []byte) error {
+		n++
+		return nil
+	})
+	if errors.Cause(err) != ErrChunkMissing {
+		t.Fatalf("Expected ErrChunkMissing but got %v", err)
+	}
+	if int64(n) != chunks[0].Records {
+		t.Fatalf("Expected records of the first chunk but got %d", n)
+	}
+
+	err = NewReader(folder, key).ScanUnordered(context.Background(), 2, func(*ReaderInfo, []byte) error {
+		return nil
+	})
+	if errors.Cause(err) != ErrChunkMissing {
+		t.Fatalf("Expected ErrChunkMissing but got %v", err)
+	}
+
+	// op failure stops the scan
+	stop := errors.New("stop")
+	err = NewReader(folder, key).ScanParallel(context.Background(), 2, func(*ReaderInfo, []byte) error {
+		return stop
+	})
+	if errors.Cause(err) != stop {
+		t.Fatalf("Expected op error but got %v", err)
+	}
+}
+
+func BenchmarkScanParallel(b *testing.B) {
+	folder, key := getBenchStore(b)
+
+	reader := NewReader(folder, key)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var bytes int64
+		err := reader.ScanParallel(context.Background(), 0, func(ri *ReaderInfo, data []byte) error {
+			bytes += int64(len(data))
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("ScanParallel: %s", err)
+		}
+		b.SetBytes(bytes)
+	}
+}
@@ -1,11 +1,12 @@
 package cellar
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 	"log"
 	"os"
-	"path"
+	"time"
 
 	"github.com/abdullin/mdb"
 	"github.com/pkg/errors"
@@ -17,6 +18,9 @@ const (
 	RF_None        ReadFlag = 0
 	RF_LoadBuffer  ReadFlag = 1 << 1
 	RF_PrintChunks ReadFlag = 1 << 2
+	// RF_Stream decodes chunks record by record instead of loading
+	// them into memory
+	RF_Stream ReadFlag = 1 << 3
 )
 
 type Reader struct {
@@ -26,10 +30,27 @@ type Reader struct {
 	StartPos    int64
 	EndPos      int64
 	LimitChunks int
+	// Keys, if set, are used instead of the Key to decrypt the chunks
+	Keys *Keyring
+	// PollInterval is how often Follow checks for new data
+	PollInterval time.Duration
 }
 
 func NewReader(folder string, key []byte) *Reader {
-	return &Reader{folder, key, RF_LoadBuffer, 0, 0, 0}
+	return &Reader{Folder: folder, Key: key, Flags: RF_LoadBuffer}
+}
+
+// NewReaderWithKeyring creates a reader that picks the key
+// for each chunk from the keyring
+func NewReaderWithKeyring(folder string, keys *Keyring) *Reader {
+	return &Reader{Folder: folder, Keys: keys, Flags: RF_LoadBuffer}
+}
+
+func (r *Reader) keyring() (*Keyring, error) {
+	if r.Keys != nil {
+		return r.Keys, nil
+	}
+	return singleKey(r.Key)
 }
 
 type ReaderInfo struct {
@@ -41,6 +62,8 @@ type ReaderInfo struct {
 	NextPos int64
 }
 
+// ReadOp receives the records of the scan. Record bytes are reused
+// by the scan, they are valid only until the op returns
 type ReadOp func(pos *ReaderInfo, data []byte) error
 
 func (r *Reader) ReadDB(op mdb.TxOp) error {
@@ -58,6 +81,24 @@ func (r *Reader) ReadDB(op mdb.TxOp) error {
 }
 
 func (r *Reader) Scan(op ReadOp) error {
+	return r.ScanContext(context.Background(), op)
+}
+
+// ScanContext is Scan that stops with the error of the context
+// once it is cancelled
+func (r *Reader) ScanContext(ctx context.Context, op ReadOp) error {
+
+	if ctx.Done() != nil {
+		inner := op
+		op = func(info *ReaderInfo, data []byte) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			return inner(info, data)
+		}
+	}
 
 	var db *mdb.DB
 	var err error
@@ -75,6 +116,7 @@ func (r *Reader) Scan(op ReadOp) error {
 
 	loadBuffer := (r.Flags & RF_LoadBuffer) == RF_LoadBuffer
 	printChunks := (r.Flags & RF_PrintChunks) == RF_PrintChunks
+	stream := (r.Flags & RF_Stream) == RF_Stream
 
 	err = db.Read(func(tx *mdb.Tx) error {
 		var err error
@@ -99,7 +141,20 @@ func (r *Reader) Scan(op ReadOp) error {
 		return nil
 	}
 
+	var keys *Keyring
+	if keys, err = r.keyring(); err != nil {
+		return err
+	}
+
 	info := &ReaderInfo{}
+	loader := r.loader(keys)
+
+	if !stream {
+		// chunks are loaded one at a time into the pooled buffer
+		buf := getChunkBuffer(getMaxByteSize(chunks, b))
+		defer chunkBuffers.Put(buf)
+		loader.buf = *buf
+	}
 
 	log.Printf("Found %d chunks and limit is %d", len(chunks), r.LimitChunks)
 
@@ -112,6 +167,10 @@ func (r *Reader) Scan(op ReadOp) error {
 
 		for i, c := range chunks {
 
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
 			endPos := c.StartPos + c.UncompressedByteSize
 
 			if r.StartPos != 0 && endPos < r.StartPos {
@@ -124,26 +183,31 @@ func (r *Reader) Scan(op ReadOp) error {
 				continue
 			}
 
-			chunk := make([]byte, c.UncompressedByteSize)
-			var file = path.Join(r.Folder, c.FileName)
-
 			if printChunks {
 				log.Printf("Loading chunk %d %s with size %d", i, c.FileName, c.UncompressedByteSize)
 			}
 
-			if chunk, err = loadChunkIntoBuffer(file, r.Key, c.UncompressedByteSize, chunk); err != nil {
-				log.Panicf("Failed to load chunk %s", c.FileName)
-			}
-
-			info.ChunkPos = c.StartPos
-
 			chunkPos := 0
 			if r.StartPos != 0 && r.StartPos > c.StartPos {
 				// reader starts in the middle
 				chunkPos = int(r.StartPos - c.StartPos)
 			}
 
-			if err = replayChunk(info, chunk, op, chunkPos); err != nil {
+			if stream {
+				if err = loader.streamChunk(c, info, op, int64(chunkPos)); err != nil {
+					return errors.Wrapf(err, "Failed to stream chunk %s", c.FileName)
+				}
+				continue
+			}
+
+			var chunk []byte
+			if chunk, err = loader.chunk(c); err != nil {
+				return errors.Wrapf(err, "Failed to load chunk %s", c.FileName)
+			}
+
+			info.ChunkPos = c.StartPos
+
+			if err = replayChunk(info, chunk, op, chunkPos, c.RecordChecksums); err != nil {
 				return errors.Wrap(err, "Failed to read chunk")
 			}
 		}
@@ -151,38 +215,36 @@ func (r *Reader) Scan(op ReadOp) error {
 
 	if loadBuffer && b != nil && b.Pos > 0 {
 
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
 		if r.EndPos != 0 && b.StartPos > r.EndPos {
 			// if buffer starts after the end of our search interval - skip it
 			return nil
 		}
 
-		loc := path.Join(r.Folder, b.FileName)
-
-		var f *os.File
+		chunkPos := 0
 
-		if f, err = os.Open(loc); err != nil {
-			log.Panicf("Failed to open buffer file %s", loc)
+		if r.StartPos > b.StartPos {
+			chunkPos = int(r.StartPos - b.StartPos)
 		}
 
-		curChunk := make([]byte, b.Pos)
-
-		var n int
-		if n, err = f.Read(curChunk); err != nil {
-			log.Panicf("Failed to read %d bytes from buffer %s", b.Pos, loc)
+		if stream {
+			if err = loader.streamBuffer(b, info, op, int64(chunkPos)); err != nil {
+				return errors.Wrapf(err, "Failed to stream buffer %s", b.FileName)
+			}
+			return nil
 		}
-		if n != int(b.Pos) {
-			log.Panic("Failed to read bytes")
+
+		var curChunk []byte
+		if curChunk, err = loader.buffer(b); err != nil {
+			return errors.Wrapf(err, "Failed to load buffer %s", b.FileName)
 		}
 
 		info.ChunkPos = b.StartPos
 
-		chunkPos := 0
-
-		if r.StartPos > b.StartPos {
-			chunkPos = int(r.StartPos - b.StartPos)
-		}
-
-		if err = replayChunk(info, curChunk, op, chunkPos); err != nil {
+		if err = replayChunk(info, curChunk, op, chunkPos, b.RecordChecksums); err != nil {
 			return errors.Wrap(err, "Failed to read chunk")
 		}
 
@@ -192,53 +254,81 @@ func (r *Reader) Scan(op ReadOp) error {
 
 }
 
-func readVarint(b []byte) (val int64, n int) {
+func readVarint(b []byte) (val int64, n int, err error) {
 
 	val, n = binary.Varint(b)
 	if n <= 0 {
-		log.Panicf("Failed to read varint %d", n)
+		return 0, 0, errors.Wrapf(ErrCorruptRecord, "Failed to read varint %d", n)
+	}
+	if val < 0 {
+		return 0, 0, errors.Wrapf(ErrCorruptRecord, "Negative record size %d", val)
 	}
 
 	return
 
 }
 
-func replayChunk(info *ReaderInfo, chunk []byte, op ReadOp, pos int) error {
+func replayChunk(info *ReaderInfo, chunk []byte, op ReadOp, pos int, checksums bool) error {
 
 	max := len(chunk)
 
 	var err error
+	var record []byte
 
 	// while we are not at the end,
-	// read first len
+	// read the next record
 	// then pass the bytes to the op
 	for pos < max {
 
 		info.StartPos = int64(pos) + info.ChunkPos
 
-		recordSize, shift := readVarint(chunk[pos:])
-
-		// move position by the header size
-		pos += shift
-
-		// get chunk
-		record := chunk[pos : pos+int(recordSize)]
-		// apply chunk
-
-		pos += int(recordSize)
+		if record, pos, err = sliceRecord(chunk, pos, checksums); err != nil {
+			return errors.Wrapf(err, "record at %d", info.StartPos)
+		}
 
 		info.NextPos = int64(pos) + info.ChunkPos
 
 		if err = op(info, record); err != nil {
 			return errors.Wrap(err, "Failed to execute op")
 		}
-		// shift pos
-
 	}
 	return nil
 
 }
 
+// sliceRecord decodes the record that starts at pos within the chunk,
+// returning it along with the position of the next record
+func sliceRecord(chunk []byte, pos int, checksums bool) ([]byte, int, error) {
+
+	recordSize, shift, err := readVarint(chunk[pos:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// move position by the header size
+	pos += shift
+
+	// compared before adding, so a huge size can't overflow
+	left := int64(len(chunk) - pos)
+	if checksums {
+		left -= recordChecksumSize
+	}
+	if recordSize > left {
+		return nil, 0, errors.Wrapf(ErrCorruptRecord, "record of %d bytes ends past the chunk", recordSize)
+	}
+
+	record := chunk[pos : pos+int(recordSize)]
+	pos += int(recordSize)
+
+	if checksums {
+		if err = checkRecordChecksum(record, chunk[pos:pos+recordChecksumSize]); err != nil {
+			return nil, 0, err
+		}
+		pos += recordChecksumSize
+	}
+	return record, pos, nil
+}
+
 func getMaxByteSize(cs []*ChunkDto, b *BufferDto) int64 {
 
 	var bufferSize int64
@@ -255,34 +345,109 @@ func getMaxByteSize(cs []*ChunkDto, b *BufferDto) int64 {
 	return bufferSize
 }
 
-func loadChunkIntoBuffer(loc string, key []byte, size int64, b []byte) ([]byte, error) {
+// chunkStream is a plaintext view of the chunk file, produced by
+// chaining the decryptor and the decompressor on top of it
+type chunkStream struct {
+	io.Reader
+	file *os.File
+}
+
+func (s *chunkStream) Close() error {
+	// some decompressors hold resources until closed
+	if c, ok := s.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return s.file.Close()
+}
+
+func openChunk(loc string, keys *Keyring, c *ChunkDto) (*chunkStream, error) {
 
 	var decryptor, zr io.Reader
 	var err error
 
+	var key []byte
+	if key, err = keys.Key(c.KeyId); err != nil {
+		return nil, errors.Wrapf(err, "chunk %s", c.FileName)
+	}
+
+	var codec Codec
+	if codec, err = CodecByID(c.Codec); err != nil {
+		return nil, errors.Wrapf(err, "chunk %s", c.FileName)
+	}
+
 	var chunkFile *os.File
 	if chunkFile, err = os.Open(loc); err != nil {
-		log.Panicf("Failed to open chunk %s", loc)
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(ErrChunkMissing, loc)
+		}
+		return nil, errors.Wrap(err, "os.Open")
 	}
 
-	defer chunkFile.Close()
+	if decryptor, err = chainChunkDecryptor(key, c, chunkFile); err != nil {
+		chunkFile.Close()
+		return nil, errors.Wrap(err, "chainDecryptor")
+	}
 
-	if decryptor, err = chainDecryptor(key, chunkFile); err != nil {
-		log.Panicf("Failed to chain decryptor for %s: %s", loc, err)
+	if zr, err = codec.NewReader(decryptor); err != nil {
+		chunkFile.Close()
+		return nil, errors.Wrapf(chunkError(err), "%s.NewReader", codec.Name())
 	}
+	return &chunkStream{zr, chunkFile}, nil
+}
+
+func loadChunkIntoBuffer(loc string, keys *Keyring, c *ChunkDto, b []byte) ([]byte, error) {
 
-	if zr, err = chainDecompressor(decryptor); err != nil {
-		log.Panicf("Failed to chain decompressor for %s: %s", loc, err)
+	var err error
+	var chunk *chunkStream
+
+	size := c.UncompressedByteSize
+
+	if chunk, err = openChunk(loc, keys, c); err != nil {
+		return nil, errors.Wrapf(err, "openChunk %s", loc)
 	}
-	//zr.Header.CompressionLevel = 4
+
+	defer chunk.Close()
+
+	// decompressor is allowed to return less than requested
 	var readBytes int
-	if readBytes, err = zr.Read(b); err != nil {
-		log.Panicf("Failed to read from chunk %s (%d): %s", loc, size, err)
+	if readBytes, err = io.ReadFull(chunk, b[0:size]); err != nil {
+		return nil, errors.Wrapf(chunkError(err), "Read %d of %d bytes from chunk %s", readBytes, size, loc)
 	}
+	return b[0:readBytes], nil
 
-	if int64(readBytes) != size {
-		log.Panicf("Read %d bytes but expected %d", readBytes, size)
+}
+
+// chunkError classifies the failures of the decryption
+// and decompression chain
+func chunkError(err error) error {
+	switch errors.Cause(err) {
+	case ErrAuthFailed:
+		return err
+	case io.EOF, io.ErrUnexpectedEOF:
+		return errors.Wrap(ErrShortRead, err.Error())
 	}
-	return b[0:readBytes], nil
+	return errors.Wrap(ErrCorruptChunk, err.Error())
+}
+
+// loadBufferFile reads the first bytes of the buffer file into the data
+func loadBufferFile(loc string, data []byte) ([]byte, error) {
+	var f *os.File
+	var err error
 
+	if f, err = os.Open(loc); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(ErrBufferMissing, loc)
+		}
+		return nil, errors.Wrap(err, "os.Open")
+	}
+	defer f.Close()
+
+	var n int
+	if n, err = io.ReadFull(f, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.Wrapf(ErrShortRead, "Read %d of %d bytes from %s", n, len(data), loc)
+		}
+		return nil, errors.Wrap(err, "Read")
+	}
+	return data, nil
 }
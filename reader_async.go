@@ -1,16 +1,20 @@
 package cellar
 
-import (
-	"log"
-)
+import "context"
 
 type Rec struct {
 	Data     []byte
 	ChunkPos int64
 	StartPos int64
 	NextPos  int64
+	// Err is set on the last record sent by ScanAsync if the scan
+	// failed, such record carries no data
+	Err error
 }
 
+// ScanAsync launches Scan in a goroutine, passing records through the
+// buffered channel. The channel is closed when the scan is over. If
+// the scan fails, the last record carries the error in Err.
 func (reader *Reader) ScanAsync(buffer int) chan *Rec {
 
 	vals := make(chan *Rec, buffer)
@@ -19,15 +23,56 @@ func (reader *Reader) ScanAsync(buffer int) chan *Rec {
 		// make sure we terminate the channel on scan read
 		defer close(vals)
 
-		err := reader.Scan(func(ri *ReaderInfo, data []byte) error {
-			vals <- &Rec{data, ri.ChunkPos, ri.StartPos, ri.NextPos}
-			return nil
-		})
-
-		if err != nil {
-			log.Panic(err)
+		if err := reader.sendRecords(context.Background(), vals); err != nil {
+			vals <- &Rec{Err: err}
 		}
 	}()
 
 	return vals
 }
+
+// AsyncScan is a scan running in the background
+type AsyncScan struct {
+	// Records delivers the records, it is closed when the scan is over
+	Records <-chan *Rec
+
+	done chan struct{}
+	err  error
+}
+
+// Err waits for the scan to finish and returns the error that
+// terminated it, nil if all records were delivered
+func (s *AsyncScan) Err() error {
+	<-s.done
+	return s.err
+}
+
+// ScanAsyncContext launches ScanContext in a goroutine, passing records
+// through the buffered channel. Cancelling the context stops the scan
+// and closes the channel, even if nobody reads from it anymore.
+func (reader *Reader) ScanAsyncContext(ctx context.Context, buffer int) *AsyncScan {
+
+	vals := make(chan *Rec, buffer)
+	scan := &AsyncScan{Records: vals, done: make(chan struct{})}
+
+	go func() {
+		scan.err = reader.sendRecords(ctx, vals)
+		close(scan.done)
+		close(vals)
+	}()
+
+	return scan
+}
+
+func (reader *Reader) sendRecords(ctx context.Context, vals chan<- *Rec) error {
+	return reader.ScanContext(ctx, func(ri *ReaderInfo, data []byte) error {
+		// scan reuses the bytes, while the channel holds the records
+		data = append([]byte(nil), data...)
+		select {
+		case vals <- &Rec{Data: data, ChunkPos: ri.ChunkPos, StartPos: ri.StartPos, NextPos: ri.NextPos}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
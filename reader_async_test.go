@@ -0,0 +1,125 @@
+package cellar
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestScanContextCancel(t *testing.T) {
+	folder, key, _, _ := writeSealed(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var count int
+	err := NewReader(folder, key).ScanContext(ctx, func(ri *ReaderInfo, data []byte) error {
+		count++
+		if count == 5 {
+			cancel()
+		}
+		return nil
+	})
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected context.Canceled but got %v", err)
+	}
+	if count != 5 {
+		t.Fatalf("Expected scan to stop after 5 records but got %d", count)
+	}
+}
+
+func TestScanAsyncContext(t *testing.T) {
+	folder, key, _, _ := writeSealed(t)
+
+	scan := NewReader(folder, key).ScanAsyncContext(context.Background(), 10)
+
+	var count int
+	for rec := range scan.Records {
+		if err := checkSeedBytes(rec.Data, count); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		count++
+	}
+	assert(t, scan.Err(), "Err")
+	if count != 40 {
+		t.Fatalf("Expected 40 records but got %d", count)
+	}
+}
+
+func TestScanAsyncContextAbandoned(t *testing.T) {
+	folder, key, _, _ := writeSealed(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// no buffer, so the producer blocks on every record
+	scan := NewReader(folder, key).ScanAsyncContext(ctx, 0)
+
+	<-scan.Records
+	cancel()
+
+	done := make(chan error)
+	go func() { done <- scan.Err() }()
+
+	select {
+	case err := <-done:
+		if errors.Cause(err) != context.Canceled {
+			t.Fatalf("Expected context.Canceled but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Scan didn't stop after the cancellation")
+	}
+
+	for range scan.Records {
+		// channel is closed after the buffered records
+	}
+}
+
+func TestScanAsyncContextDeliversError(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	assert(t, os.Remove(path.Join(folder, chunks[1].FileName)), "Remove")
+
+	scan := NewReader(folder, key).ScanAsyncContext(context.Background(), 10)
+	for range scan.Records {
+	}
+	if errors.Cause(scan.Err()) != ErrChunkMissing {
+		t.Fatalf("Expected ErrChunkMissing but got %v", scan.Err())
+	}
+}
+
+func TestScanAsyncStream(t *testing.T) {
+	folder, key, _, _ := writeSealed(t)
+
+	reader := NewReader(folder, key)
+	reader.Flags |= RF_Stream
+
+	// channel holds all records before any of them is read
+	scan := reader.ScanAsyncContext(context.Background(), 40)
+	assert(t, scan.Err(), "Err")
+
+	var count int
+	for rec := range scan.Records {
+		if err := checkSeedBytes(rec.Data, count); err != nil {
+			t.Fatalf("Failed seed check of record %d: %s", count, err)
+		}
+		count++
+	}
+	if count != 40 {
+		t.Fatalf("Expected 40 records but got %d", count)
+	}
+
+	count = 0
+	recs := reader.ScanAsync(40)
+	for len(recs) < 40 {
+		time.Sleep(time.Millisecond)
+	}
+	for rec := range recs {
+		if err := checkSeedBytes(rec.Data, count); err != nil {
+			t.Fatalf("Failed seed check of async record %d: %s", count, err)
+		}
+		count++
+	}
+}
@@ -0,0 +1,184 @@
+package cellar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// ReadAt loads a single record that starts at the given global position.
+// Positions are the ones reported by ReaderInfo.StartPos (or
+// Writer.VolatilePos before the Append). Only the chunk owning the
+// position is decoded and the scan stops right after the record.
+func (r *Reader) ReadAt(pos int64) ([]byte, *ReaderInfo, error) {
+
+	var db *mdb.DB
+	var err error
+
+	cfg := mdb.NewConfig()
+	if db, err = mdb.New(r.Folder, cfg); err != nil {
+		return nil, nil, errors.Wrap(err, "mdb.New")
+	}
+
+	defer db.Close()
+
+	var b *BufferDto
+	var chunks []*ChunkDto
+	var meta *MetaDto
+
+	err = db.Read(func(tx *mdb.Tx) error {
+		var err error
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		if meta, err = lmdbGetCellarMeta(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetCellarMeta")
+		}
+		if chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "db.Read")
+	}
+
+	if pos < 0 {
+		return nil, nil, errors.Wrapf(ErrInvalidPosition, "%d", pos)
+	}
+	if meta != nil && pos < meta.LowWaterMark {
+		return nil, nil, errors.Wrapf(ErrTruncated, "%d is before %d", pos, meta.LowWaterMark)
+	}
+
+	var keys *Keyring
+	if keys, err = r.keyring(); err != nil {
+		return nil, nil, err
+	}
+	// sealed buffer is read from its chunk
+	loader := &fileLoader{folder: r.Folder, keys: keys, db: db}
+
+	if b != nil && pos >= b.StartPos {
+		if pos >= b.StartPos+b.Pos {
+			return nil, nil, errors.Wrapf(ErrInvalidPosition, "%d is past the last checkpoint", pos)
+		}
+		return loader.readBuffer(b, pos)
+	}
+
+	// chunks are listed in the order of their start positions
+	i := sort.Search(len(chunks), func(i int) bool {
+		return chunks[i].StartPos > pos
+	}) - 1
+
+	if i < 0 {
+		return nil, nil, errors.Wrapf(ErrInvalidPosition, "%d", pos)
+	}
+
+	c := chunks[i]
+	if pos >= c.StartPos+c.UncompressedByteSize {
+		return nil, nil, errors.Wrapf(ErrInvalidPosition, "%d", pos)
+	}
+
+	return loader.readChunk(c, pos)
+}
+
+func readChunkRecord(loc string, keys *Keyring, c *ChunkDto, pos int64) ([]byte, *ReaderInfo, error) {
+
+	var err error
+	var chunk *chunkStream
+
+	if chunk, err = openChunk(loc, keys, c); err != nil {
+		return nil, nil, errors.Wrapf(err, "openChunk %s", loc)
+	}
+	defer chunk.Close()
+
+	offset := pos - c.StartPos
+
+	if _, err = io.CopyN(ioutil.Discard, chunk, offset); err != nil {
+		return nil, nil, errors.Wrapf(chunkError(err), "Skip %d bytes in %s", offset, loc)
+	}
+
+	return readRecord(bufio.NewReader(chunk), c.StartPos, pos, c.StartPos+c.UncompressedByteSize, c.RecordChecksums)
+}
+
+func readBufferRecord(loc string, b *BufferDto, pos int64) ([]byte, *ReaderInfo, error) {
+
+	var err error
+	var f *os.File
+
+	if f, err = os.Open(loc); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, errors.Wrap(ErrBufferMissing, loc)
+		}
+		return nil, nil, errors.Wrap(err, "os.Open")
+	}
+	defer f.Close()
+
+	end := b.StartPos + b.Pos
+	src := io.NewSectionReader(f, pos-b.StartPos, end-pos)
+
+	return readRecord(bufio.NewReader(src), b.StartPos, pos, end, b.RecordChecksums)
+}
+
+// readRecord decodes a single varint-framed record from the reader
+// positioned at the global position pos. The record has to end
+// before the end position
+func readRecord(src *bufio.Reader, chunkPos, pos, end int64, checksums bool) ([]byte, *ReaderInfo, error) {
+
+	recordSize, err := binary.ReadVarint(src)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, errors.Wrapf(ErrShortRead, "Read varint at %d", pos)
+		}
+		return nil, nil, errors.Wrapf(ErrCorruptRecord, "Read varint at %d: %s", pos, err)
+	}
+
+	header := int64(varintSize(recordSize))
+
+	// compared before adding, so a huge size can't overflow
+	left := end - pos - header
+	if checksums {
+		left -= recordChecksumSize
+	}
+	if recordSize < 0 || recordSize > left {
+		return nil, nil, errors.Wrapf(ErrInvalidPosition, "%d has record of %d bytes", pos, recordSize)
+	}
+
+	next := pos + header + recordSize
+	if checksums {
+		next += recordChecksumSize
+	}
+
+	record := make([]byte, recordSize)
+	if _, err = io.ReadFull(src, record); err != nil {
+		return nil, nil, errors.Wrapf(ErrShortRead, "Read %d bytes at %d: %s", recordSize, pos, err)
+	}
+
+	if checksums {
+		sum := make([]byte, recordChecksumSize)
+		if _, err = io.ReadFull(src, sum); err != nil {
+			return nil, nil, errors.Wrapf(ErrShortRead, "Read checksum at %d: %s", pos, err)
+		}
+		if err = checkRecordChecksum(record, sum); err != nil {
+			return nil, nil, errors.Wrapf(err, "record at %d", pos)
+		}
+	}
+
+	info := &ReaderInfo{
+		ChunkPos: chunkPos,
+		StartPos: pos,
+		NextPos:  next,
+	}
+	return record, info, nil
+}
+
+func varintSize(v int64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutVarint(buf[:], v)
+}
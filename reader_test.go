@@ -0,0 +1,56 @@
+package cellar
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadAt(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	defer closeWriter(t, w)
+
+	var recs []rec
+
+	for i := 0; i < 40; i++ {
+		size := 10 + i*3
+		recs = append(recs, rec{pos: w.VolatilePos(), seed: i, size: size})
+
+		if _, err = w.Append(genSeedBytes(size, i)); err != nil {
+			t.Fatalf("Append failed: %s", err)
+		}
+	}
+	assertCheckpoint(t, w)
+
+	reader := NewReader(folder, key)
+
+	// go backwards, to make sure we don't depend on the previous reads
+	for i := len(recs) - 1; i >= 0; i-- {
+		r := recs[i]
+
+		data, info, err := reader.ReadAt(r.pos)
+		assert(t, err, "ReadAt")
+
+		if len(data) != r.size {
+			t.Fatalf("Expected %d bytes at %d but got %d", r.size, r.pos, len(data))
+		}
+		if err := checkSeedBytes(data, r.seed); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		if info.StartPos != r.pos {
+			t.Fatalf("Expected start pos %d but got %d", r.pos, info.StartPos)
+		}
+		if i+1 < len(recs) && info.NextPos != recs[i+1].pos {
+			t.Fatalf("Expected next pos %d but got %d", recs[i+1].pos, info.NextPos)
+		}
+	}
+
+	if _, _, err = reader.ReadAt(w.VolatilePos()); errors.Cause(err) != ErrInvalidPosition {
+		t.Fatalf("Expected ErrInvalidPosition past the end, got %v", err)
+	}
+}
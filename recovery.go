@@ -0,0 +1,243 @@
+package cellar
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// names of the steps where a crash could be simulated in tests
+const (
+	crashCheckpointFlushed = "checkpoint.flushed"
+	crashSealFlushed       = "seal.flushed"
+	crashSealCompressed    = "seal.compressed"
+	crashSealCommitted     = "seal.committed"
+	crashRotateWritten     = "rotate.written"
+	crashRotateCommitted   = "rotate.committed"
+	crashTruncateCommitted = "truncate.committed"
+)
+
+// crashPoint is a fault injection hook for the tests. It is called at
+// the named steps of the writer and aborts them by returning an error
+var crashPoint = func(name string) error { return nil }
+
+// files that are created by the writer in the folder
+var (
+	bufferFileRe = regexp.MustCompile(`^\d{12}$`)
+	// chunks re-encrypted by the key rotation carry the key ID,
+	// the extension is the name of the codec
+	chunkFileRe = regexp.MustCompile(`^\d{12}(\.k\d+)?\.([a-z][a-z0-9]*)(\.tmp)?$`)
+)
+
+// isChunkFile checks if the file could be a chunk written by the
+// writer. Files with other extensions are left alone
+func isChunkFile(name string) bool {
+	m := chunkFileRe.FindStringSubmatch(name)
+	if m == nil {
+		return false
+	}
+	_, err := LookupCodec(m[2])
+	return err == nil
+}
+
+// RecoveryReport describes the repairs performed while opening a writer
+// that was not closed properly
+type RecoveryReport struct {
+	// RemovedFiles lists chunk and buffer files that were not referenced
+	// by the metadata DB and got removed
+	RemovedFiles []string
+	// TruncatedBytes is a lower bound of the bytes discarded from the
+	// buffer past the last checkpoint. The buffer is preallocated with
+	// zeros, so the trailing zero bytes (like zero-length records or
+	// zero payloads) can't be told apart from the unused space and
+	// aren't counted
+	TruncatedBytes int64
+	// Resealed is set when an interrupted seal of the buffer was completed
+	Resealed bool
+	// RecreatedBuffer is set when the buffer file had to be created anew
+	RecreatedBuffer bool
+	// MissingChunks lists registered chunks that don't exist on disk.
+	// These can't be repaired
+	MissingChunks []string
+}
+
+// Clean returns true if no repairs were detected. Uncheckpointed
+// records made of zero bytes are discarded without being detected,
+// see TruncatedBytes
+func (r *RecoveryReport) Clean() bool {
+	return len(r.RemovedFiles) == 0 && r.TruncatedBytes == 0 &&
+		!r.Resealed && !r.RecreatedBuffer && len(r.MissingChunks) == 0
+}
+
+// recoverFolder reconciles files in the folder with the state recorded
+// in the metadata DB. It has to run before the buffer is opened.
+func recoverFolder(db *mdb.DB, folder string, maxBufferSize int64, logger Logger) (*RecoveryReport, error) {
+
+	var dto *BufferDto
+	var chunks []*ChunkDto
+	var err error
+
+	err = db.Read(func(tx *mdb.Tx) error {
+		var err error
+		if dto, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		if chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "db.Read")
+	}
+
+	report := &RecoveryReport{}
+
+	known := make(map[string]bool)
+	sealed := make(map[int64]*ChunkDto)
+
+	for _, c := range chunks {
+		known[c.FileName] = true
+		sealed[c.StartPos] = c
+
+		if _, err = os.Stat(path.Join(folder, c.FileName)); os.IsNotExist(err) {
+			logger.Printf("Chunk %s is missing", c.FileName)
+			report.MissingChunks = append(report.MissingChunks, c.FileName)
+		}
+	}
+
+	var interrupted bool
+
+	if dto != nil {
+
+		if c, found := sealed[dto.StartPos]; found {
+			// buffer was sealed but never replaced
+			err = db.Update(func(tx *mdb.Tx) error {
+				next := c.StartPos + c.UncompressedByteSize
+				var b *Buffer
+				var err error
+				if b, err = createBuffer(tx, next, maxBufferSize, folder, dto.RecordChecksums); err != nil {
+					return errors.Wrap(err, "createBuffer")
+				}
+				dto = b.getState()
+				return b.close()
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "db.Update")
+			}
+			logger.Printf("Replaced sealed buffer with %s", dto.FileName)
+			report.RecreatedBuffer = true
+		}
+
+		if report.TruncatedBytes, err = truncateBuffer(folder, dto, logger); err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				return nil, errors.Wrap(err, "truncateBuffer")
+			}
+			if dto.Pos > 0 {
+				return nil, errors.Errorf("Buffer %s with %d checkpointed bytes is missing", dto.FileName, dto.Pos)
+			}
+			logger.Printf("Buffer %s is missing, recreating", dto.FileName)
+			report.RecreatedBuffer = true
+		}
+		known[dto.FileName] = true
+	}
+
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(folder); err != nil {
+		return nil, errors.Wrap(err, "ReadDir")
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if known[name] || !(bufferFileRe.MatchString(name) || isChunkFile(name)) {
+			continue
+		}
+		if dto != nil && isSealOf(dto.FileName, name) {
+			interrupted = true
+		}
+		if err = os.Remove(path.Join(folder, name)); err != nil {
+			return nil, errors.Wrap(err, "Remove")
+		}
+		logger.Printf("Removed orphaned file %s", name)
+		report.RemovedFiles = append(report.RemovedFiles, name)
+	}
+
+	// seal got interrupted before the chunk was registered. Since the
+	// buffer was deemed full, we complete the seal with the checkpointed data
+	report.Resealed = interrupted && dto.Pos > 0
+
+	return report, nil
+}
+
+// isSealOf checks if the file is the chunk produced by sealing the buffer
+func isSealOf(bufferName, name string) bool {
+	if !strings.HasPrefix(name, bufferName+".") {
+		return false
+	}
+	// rotated and temporary chunks have more extensions
+	return !strings.Contains(name[len(bufferName)+1:], ".")
+}
+
+// truncateBuffer discards everything past the checkpointed position
+// of the buffer and returns the number of bytes discarded up to the
+// last non-zero one, which is a lower bound of the discarded data
+func truncateBuffer(folder string, dto *BufferDto, logger Logger) (int64, error) {
+
+	var f *os.File
+	var err error
+
+	if f, err = os.OpenFile(path.Join(folder, dto.FileName), os.O_RDWR, 0644); err != nil {
+		return 0, errors.Wrap(err, "OpenFile")
+	}
+	defer f.Close()
+
+	var size int64
+	if size, err = f.Seek(0, io.SeekEnd); err != nil {
+		return 0, errors.Wrap(err, "Seek")
+	}
+	if size < dto.Pos {
+		return 0, errors.Errorf("Buffer %s has %d bytes, but %d were checkpointed", dto.FileName, size, dto.Pos)
+	}
+
+	// buffer is preallocated, so the tail is the range
+	// up to the last non-zero byte
+	var tail int64
+	var n int
+	block := make([]byte, 64*1024)
+	for pos := dto.Pos; pos < size; pos += int64(n) {
+		if n, err = f.ReadAt(block, pos); err != nil && err != io.EOF {
+			return 0, errors.Wrap(err, "ReadAt")
+		}
+		if i := lastNonZero(block[:n]); i >= 0 {
+			tail = pos + int64(i) + 1 - dto.Pos
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	if tail == 0 {
+		return 0, nil
+	}
+
+	logger.Printf("Discarding at least %d bytes past the checkpoint in %s", tail, dto.FileName)
+
+	if err = f.Truncate(dto.Pos); err != nil {
+		return 0, errors.Wrap(err, "Truncate")
+	}
+	if err = f.Sync(); err != nil {
+		return 0, errors.Wrap(err, "Sync")
+	}
+	return tail, nil
+}
+
+func lastNonZero(b []byte) int {
+	return len(bytes.TrimRight(b, "\x00")) - 1
+}
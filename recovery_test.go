@@ -0,0 +1,236 @@
+package cellar
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// crashAt makes the writer fail at the named step
+func crashAt(name string) func() {
+	crashPoint = func(n string) error {
+		if n == name {
+			return errCrash
+		}
+		return nil
+	}
+	return func() {
+		crashPoint = func(string) error { return nil }
+	}
+}
+
+// abandon drops the writer without flushing or checkpointing
+func abandon(w *Writer) {
+	w.b.close()
+	w.db.Close()
+	// the OS drops the locks of a dead process
+	w.lock.release()
+}
+
+// appendUntilCrash fills the writer and returns the number of
+// records that were checkpointed before the crash
+func appendUntilCrash(t *testing.T, w *Writer) int {
+	var checkpointed int
+	for i := 0; ; i++ {
+		if _, err := w.Append(genSeedBytes(64, i)); err != nil {
+			if errors.Cause(err) != errCrash {
+				t.Fatalf("Expected crash but got %s", err)
+			}
+			return checkpointed
+		}
+		if i%4 == 3 {
+			if _, err := w.Checkpoint(); err != nil {
+				if errors.Cause(err) != errCrash {
+					t.Fatalf("Expected crash but got %s", err)
+				}
+				return checkpointed
+			}
+			checkpointed = i + 1
+		}
+	}
+}
+
+func assertRecords(t *testing.T, folder string, key []byte, count int) {
+	reader := NewReader(folder, key)
+	var n int
+	err := reader.Scan(func(pos *ReaderInfo, s []byte) error {
+		if err := checkSeedBytes(s, n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+		return nil
+	})
+	assert(t, err, "Scan")
+	if n != count {
+		t.Fatalf("Expected %d records but got %d", count, n)
+	}
+}
+
+func TestRecoveryAtCrashPoints(t *testing.T) {
+
+	cases := []struct {
+		point    string
+		check    func(r *RecoveryReport) bool
+		sealed   bool
+		describe string
+	}{
+		{crashCheckpointFlushed, func(r *RecoveryReport) bool {
+			return r.TruncatedBytes > 0 && !r.Resealed
+		}, false, "truncate tail"},
+		{crashSealFlushed, func(r *RecoveryReport) bool {
+			return r.TruncatedBytes > 0 && !r.Resealed && len(r.RemovedFiles) == 0
+		}, false, "truncate tail"},
+		{crashSealCompressed, func(r *RecoveryReport) bool {
+			return r.Resealed && len(r.RemovedFiles) == 1
+		}, true, "remove orphan chunk and reseal"},
+		{crashSealCommitted, func(r *RecoveryReport) bool {
+			return len(r.RemovedFiles) == 1 && !r.Resealed && r.TruncatedBytes == 0
+		}, true, "remove old buffer"},
+	}
+
+	for _, c := range cases {
+		folder := getFolder()
+		key := genRandBytes(16)
+
+		w, err := NewWriter(folder, 1000, key)
+		assert(t, err, "NewWriter")
+		if !w.Recovery().Clean() {
+			t.Fatalf("%s: new writer should have a clean recovery", c.point)
+		}
+
+		restore := crashAt(c.point)
+		checkpointed := appendUntilCrash(t, w)
+		restore()
+		abandon(w)
+
+		if w, err = NewWriter(folder, 1000, key); err != nil {
+			t.Fatalf("%s: failed to recover: %s", c.point, err)
+		}
+
+		report := w.Recovery()
+		if !c.check(report) {
+			t.Fatalf("%s: expected to %s, got %+v", c.point, c.describe, report)
+		}
+
+		var chunks []*ChunkDto
+		err = w.ReadDB(func(tx *mdb.Tx) error {
+			chunks, err = lmdbListChunks(tx)
+			return err
+		})
+		assert(t, err, "lmdbListChunks")
+		if c.sealed != (len(chunks) > 0) {
+			t.Fatalf("%s: expected sealed %t but got %d chunks", c.point, c.sealed, len(chunks))
+		}
+
+		if c.point == crashSealCommitted {
+			// seal persists everything that was appended
+			checkpointed = int(chunks[0].Records)
+		}
+
+		assertRecords(t, folder, key, checkpointed)
+
+		// writer should continue where it stopped
+		for i := checkpointed; i < checkpointed+20; i++ {
+			_, err = w.Append(genSeedBytes(64, i))
+			assert(t, err, "Append")
+		}
+		assertCheckpoint(t, w)
+		closeWriter(t, w)
+
+		assertRecords(t, folder, key, checkpointed+20)
+	}
+}
+
+func TestRecoveryOfMissingBuffer(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	closeWriter(t, w)
+
+	assert(t, os.Remove(path.Join(folder, "000000000000")), "Remove")
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	if !w.Recovery().RecreatedBuffer {
+		t.Fatalf("Buffer should be recreated, got %+v", w.Recovery())
+	}
+}
+
+func TestRecoveryTruncatedBytesLowerBound(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	_, err = w.Append(genSeedBytes(64, 0))
+	assert(t, err, "Append")
+	assertCheckpoint(t, w)
+
+	// zero-length record looks like the unused space
+	_, err = w.Append(nil)
+	assert(t, err, "Append")
+	assert(t, w.b.flush(), "flush")
+	abandon(w)
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	if r := w.Recovery(); r.TruncatedBytes != 0 {
+		t.Fatalf("Expected undetected zero record, got %d bytes", r.TruncatedBytes)
+	}
+
+	// zeros before the last non-zero byte are counted
+	_, err = w.Append(nil)
+	assert(t, err, "Append")
+	_, err = w.Append(genSeedBytes(64, 1))
+	assert(t, err, "Append")
+	assert(t, w.b.flush(), "flush")
+	abandon(w)
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+	if r := w.Recovery(); r.TruncatedBytes != int64(w.framedSize(0)+w.framedSize(64)) {
+		t.Fatalf("Expected both records counted, got %d bytes", r.TruncatedBytes)
+	}
+	assertRecords(t, folder, key, 1)
+}
+
+func TestRecoveryKeepsForeignFiles(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	closeWriter(t, w)
+
+	orphan := "000000099000.lz4"
+	foreign := []string{"000000099000.bak", "000000099000.k1.old"}
+	for _, name := range append(foreign, orphan) {
+		assert(t, os.WriteFile(path.Join(folder, name), []byte("data"), 0644), "WriteFile")
+	}
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	if r := w.Recovery(); len(r.RemovedFiles) != 1 || r.RemovedFiles[0] != orphan {
+		t.Fatalf("Expected only %s removed, got %v", orphan, r.RemovedFiles)
+	}
+	for _, name := range foreign {
+		if _, err = os.Stat(path.Join(folder, name)); err != nil {
+			t.Fatalf("Expected %s to be kept: %s", name, err)
+		}
+	}
+}
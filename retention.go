@@ -0,0 +1,197 @@
+package cellar
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy limits the sealed chunks kept in the folder. The
+// oldest chunks are dropped until all the limits are met, zero fields
+// don't limit anything. The buffer is never dropped.
+type RetentionPolicy struct {
+	// MaxAge drops the chunks sealed longer than that ago
+	MaxAge time.Duration
+	// MaxBytes limits the disk size of all chunks
+	MaxBytes int64
+	// MaxChunks limits the number of chunks
+	MaxChunks int
+}
+
+func (p RetentionPolicy) empty() bool {
+	return p.MaxAge == 0 && p.MaxBytes == 0 && p.MaxChunks == 0
+}
+
+// expired returns the number of the leading chunks to drop
+func (p RetentionPolicy) expired(folder string, chunks []*ChunkDto, now time.Time) int {
+
+	var n int
+
+	if p.MaxChunks > 0 && len(chunks) > p.MaxChunks {
+		n = len(chunks) - p.MaxChunks
+	}
+
+	if p.MaxBytes > 0 {
+		var total int64
+		for _, c := range chunks {
+			total += c.CompressedDiskSize
+		}
+		for i := 0; total > p.MaxBytes; i++ {
+			total -= chunks[i].CompressedDiskSize
+			if i+1 > n {
+				n = i + 1
+			}
+		}
+	}
+
+	if p.MaxAge > 0 {
+		deadline := now.Add(-p.MaxAge)
+		for i, c := range chunks {
+			if !sealedAt(folder, c).Before(deadline) {
+				break
+			}
+			if i+1 > n {
+				n = i + 1
+			}
+		}
+	}
+	return n
+}
+
+// sealedAt falls back to the file time for the chunks
+// that were sealed before the time was recorded
+func sealedAt(folder string, c *ChunkDto) time.Time {
+	if c.SealedAt != 0 {
+		return time.Unix(c.SealedAt, 0)
+	}
+	if fi, err := os.Stat(path.Join(folder, c.FileName)); err == nil {
+		return fi.ModTime()
+	}
+	// keep the chunks of unknown age
+	return time.Now()
+}
+
+// ApplyRetention drops the oldest chunks that exceed the limits of
+// the policy and returns the low-water mark
+func (w *Writer) ApplyRetention(p RetentionPolicy) (int64, error) {
+
+	if err := w.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	var chunks []*ChunkDto
+	err := w.db.Read(func(tx *mdb.Tx) error {
+		var err error
+		chunks, err = lmdbListChunks(tx)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "lmdbListChunks")
+	}
+
+	n := p.expired(w.folder, chunks, time.Now())
+	if n == 0 {
+		return w.lowWaterMark, nil
+	}
+	last := chunks[n-1]
+	return w.TruncateBefore(last.StartPos + last.UncompressedByteSize)
+}
+
+// TruncateBefore drops the chunks that end at or before the position,
+// the chunk containing the position is kept whole. Positions of the
+// remaining records don't change. Returns the low-water mark - the
+// position of the first record that is kept.
+//
+// Chunks are removed from the metadata DB first, so new readers don't
+// see them. Readers that listed the chunks earlier fail with
+// ErrTruncated when they get to the deleted file.
+func (w *Writer) TruncateBefore(pos int64) (int64, error) {
+
+	if err := w.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	var dropped []*ChunkDto
+
+	lowWaterMark := w.lowWaterMark
+
+	err := w.db.Update(func(tx *mdb.Tx) error {
+		chunks, err := lmdbListChunks(tx)
+		if err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+
+		for _, c := range chunks {
+			end := c.StartPos + c.UncompressedByteSize
+			if end > pos {
+				break
+			}
+			if err = lmdbDelChunk(tx, c.StartPos); err != nil {
+				return errors.Wrap(err, "lmdbDelChunk")
+			}
+			dropped = append(dropped, c)
+			lowWaterMark = end
+		}
+		if len(dropped) == 0 {
+			return nil
+		}
+
+		meta := w.getMeta()
+		meta.LowWaterMark = lowWaterMark
+		return lmdbSetCellarMeta(tx, meta)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "w.db.Update")
+	}
+	if len(dropped) == 0 {
+		return w.lowWaterMark, nil
+	}
+
+	w.lowWaterMark = lowWaterMark
+
+	w.log.Printf("Truncated %d chunks before %d", len(dropped), lowWaterMark)
+	if w.hooks.OnTruncate != nil {
+		w.hooks.OnTruncate(lowWaterMark)
+	}
+
+	if err = crashPoint(crashTruncateCommitted); err != nil {
+		return 0, err
+	}
+
+	// files left by a crash are removed as orphans on the next open
+	for _, c := range dropped {
+		loc := path.Join(w.folder, c.FileName)
+		if err = os.Remove(loc); err != nil && !os.IsNotExist(err) {
+			w.log.Printf("Can't remove truncated chunk %s: %s", loc, err)
+		}
+	}
+	return lowWaterMark, nil
+}
+
+// LowWaterMark returns the position of the first record that
+// wasn't truncated
+func (w *Writer) LowWaterMark() int64 {
+	return w.lowWaterMark
+}
+
+// LowWaterMark returns the position of the first record that
+// wasn't truncated, records before it can't be read
+func (r *Reader) LowWaterMark() (int64, error) {
+
+	var meta *MetaDto
+	err := r.ReadDB(func(tx *mdb.Tx) error {
+		var err error
+		meta, err = lmdbGetCellarMeta(tx)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "lmdbGetCellarMeta")
+	}
+	if meta == nil {
+		return 0, nil
+	}
+	return meta.LowWaterMark, nil
+}
@@ -0,0 +1,231 @@
+package cellar
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestTruncateBefore(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+	recs := writeChecksummed(t, folder, key, 100)
+
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+	chunks := listChunks(t, folder, keys)
+	if len(chunks) < 4 {
+		t.Fatalf("Expected at least 4 chunks but got %d", len(chunks))
+	}
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	// snapshot is taken before the truncation
+	it := NewReader(folder, key).Iterate()
+	if !it.Next() {
+		t.Fatalf("Expected the first record: %v", it.Err())
+	}
+
+	// the chunk with the position is kept
+	lwm, err := w.TruncateBefore(chunks[2].StartPos + 1)
+	assert(t, err, "TruncateBefore")
+	if lwm != chunks[2].StartPos || w.LowWaterMark() != lwm {
+		t.Fatalf("Expected low-water mark %d but got %d", chunks[2].StartPos, lwm)
+	}
+	for _, c := range chunks[:2] {
+		if _, err = os.Stat(path.Join(folder, c.FileName)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed but got %v", c.FileName, err)
+		}
+	}
+	for it.Next() {
+	}
+	if errors.Cause(it.Err()) != ErrTruncated {
+		t.Fatalf("Expected ErrTruncated from the old snapshot but got %v", it.Err())
+	}
+
+	// nothing left to drop
+	lwm, err = w.TruncateBefore(chunks[2].StartPos)
+	assert(t, err, "TruncateBefore")
+	if lwm != chunks[2].StartPos {
+		t.Fatalf("Expected the same low-water mark but got %d", lwm)
+	}
+	closeWriter(t, w)
+
+	reader := NewReader(folder, key)
+	if lwm, err = reader.LowWaterMark(); err != nil || lwm != chunks[2].StartPos {
+		t.Fatalf("Expected reader low-water mark %d but got %d, %v", chunks[2].StartPos, lwm, err)
+	}
+
+	// positions of the remaining records don't change
+	var kept []rec
+	for _, r := range recs {
+		if r.pos >= lwm {
+			kept = append(kept, r)
+		}
+	}
+	var n int
+	err = reader.Scan(func(ri *ReaderInfo, data []byte) error {
+		if ri.StartPos != kept[n].pos {
+			t.Fatalf("Expected record at %d but got %d", kept[n].pos, ri.StartPos)
+		}
+		if err := checkSeedBytes(data, kept[n].seed); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+		return nil
+	})
+	assert(t, err, "Scan")
+	if n != len(kept) {
+		t.Fatalf("Expected %d records but got %d", len(kept), n)
+	}
+
+	if _, _, err = reader.ReadAt(recs[0].pos); errors.Cause(err) != ErrTruncated {
+		t.Fatalf("Expected ErrTruncated but got %v", err)
+	}
+	_, _, err = reader.ReadAt(kept[0].pos)
+	assert(t, err, "ReadAt")
+
+	// low-water mark survives the reopen
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+	if w.LowWaterMark() != lwm {
+		t.Fatalf("Expected low-water mark %d after reopen but got %d", lwm, w.LowWaterMark())
+	}
+}
+
+func TestTruncateCrash(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+	writeChecksummed(t, folder, key, 100)
+
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+	chunks := listChunks(t, folder, keys)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	restore := crashAt(crashTruncateCommitted)
+	_, err = w.TruncateBefore(chunks[1].StartPos)
+	restore()
+	if errors.Cause(err) != errCrash {
+		t.Fatalf("Expected crash but got %v", err)
+	}
+	abandon(w)
+
+	// dropped chunk is an orphan now
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	removed := w.Recovery().RemovedFiles
+	if len(removed) != 1 || removed[0] != chunks[0].FileName {
+		t.Fatalf("Expected %s to be removed but got %v", chunks[0].FileName, removed)
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	now := time.Now()
+
+	var chunks []*ChunkDto
+	for i := 0; i < 5; i++ {
+		chunks = append(chunks, &ChunkDto{
+			StartPos:             int64(i) * 100,
+			UncompressedByteSize: 100,
+			CompressedDiskSize:   50,
+			SealedAt:             now.Add(time.Duration(i-5) * time.Hour).Unix(),
+		})
+	}
+
+	cases := []struct {
+		policy   RetentionPolicy
+		expected int
+	}{
+		{RetentionPolicy{}, 0},
+		{RetentionPolicy{MaxChunks: 3}, 2},
+		{RetentionPolicy{MaxChunks: 10}, 0},
+		{RetentionPolicy{MaxBytes: 120}, 3},
+		{RetentionPolicy{MaxBytes: 250}, 0},
+		{RetentionPolicy{MaxAge: 150 * time.Minute}, 3},
+		// the strictest limit wins
+		{RetentionPolicy{MaxChunks: 4, MaxBytes: 160, MaxAge: 10 * time.Hour}, 2},
+	}
+	for _, c := range cases {
+		if n := c.policy.expired("", chunks, now); n != c.expected {
+			t.Fatalf("Expected %+v to drop %d chunks but got %d", c.policy, c.expected, n)
+		}
+	}
+
+	// policy is applied on seal
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	var truncated int64
+	w, err := NewWriterWithOptions(folder, Options{
+		BufferSize: 1000,
+		Key:        key,
+		Retention:  RetentionPolicy{MaxChunks: 2},
+		Hooks:      Hooks{OnTruncate: func(lwm int64) { truncated = lwm }},
+	})
+	assert(t, err, "NewWriterWithOptions")
+	defer closeWriter(t, w)
+
+	for i := 0; i < 100; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+	left := listChunks(t, folder, keys)
+	if len(left) != 2 {
+		t.Fatalf("Expected 2 chunks to be kept but got %d", len(left))
+	}
+	if truncated != left[0].StartPos || w.LowWaterMark() != truncated {
+		t.Fatalf("Expected low-water mark %d but got %d", left[0].StartPos, truncated)
+	}
+	assertFiles(t, folder, left)
+}
+
+func TestRetentionFailureKeepsAppend(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	var failures int
+	w, err := NewWriterWithOptions(folder, Options{
+		BufferSize: 1000,
+		Key:        key,
+		Retention:  RetentionPolicy{MaxChunks: 1},
+		Hooks:      Hooks{OnRetentionError: func(error) { failures++ }},
+	})
+	assert(t, err, "NewWriterWithOptions")
+	defer closeWriter(t, w)
+
+	// truncation fails after each seal
+	restore := crashAt(crashTruncateCommitted)
+	var positions [][]int64
+	for i := 0; i < 20; i++ {
+		batch := [][]byte{genSeedBytes(64, 2*i), genSeedBytes(64, 2*i+1)}
+		pos, err := w.AppendBatch(batch)
+		assert(t, err, "AppendBatch")
+		positions = append(positions, pos)
+	}
+	restore()
+	assertCheckpoint(t, w)
+
+	if failures == 0 {
+		t.Fatal("Expected the retention failure to be reported")
+	}
+	for i, pos := range positions {
+		if len(pos) != 2 {
+			t.Fatalf("Expected positions of batch %d, got %v", i, pos)
+		}
+	}
+}
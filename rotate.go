@@ -0,0 +1,233 @@
+package cellar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// RotateProgress is called after each re-encrypted chunk
+type RotateProgress func(done, total int)
+
+// RotateKeys re-encrypts all chunks that don't use the current key of
+// the keyring (legacy chunks are upgraded to the authenticated format
+// on the way). Every chunk is committed on its own, so an interrupted
+// rotation resumes where it stopped when started again.
+//
+// This is the offline version, it fails with ErrLocked while there is
+// a writer in the folder. Use Writer.RotateKeys instead.
+func RotateKeys(folder string, keys *Keyring, progress RotateProgress) error {
+	var db *mdb.DB
+	var err error
+
+	var lock *folderLock
+	if lock, err = lockFolder(folder); err != nil {
+		return err
+	}
+	defer lock.release()
+
+	cfg := mdb.NewConfig()
+	cfg.EnvFlags = 0
+
+	if db, err = mdb.New(folder, cfg); err != nil {
+		return errors.Wrap(err, "mdb.New")
+	}
+
+	defer db.Close()
+
+	return rotateKeys(db, folder, keys, progress, stdLogger{})
+}
+
+// RotateKeys re-encrypts all chunks that don't use the current key
+// of the writer's keyring. See RotateKeys for the details
+func (w *Writer) RotateKeys(progress RotateProgress) error {
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
+	return rotateKeys(w.db, w.folder, w.keys, progress, w.log)
+}
+
+func rotateKeys(db *mdb.DB, folder string, keys *Keyring, progress RotateProgress, logger Logger) error {
+
+	var err error
+	if err = keys.check(); err != nil {
+		return err
+	}
+
+	var chunks []*ChunkDto
+	err = db.Read(func(tx *mdb.Tx) error {
+		var err error
+		chunks, err = lmdbListChunks(tx)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "lmdbListChunks")
+	}
+
+	id, _ := keys.Current()
+
+	var stale []*ChunkDto
+	for _, c := range chunks {
+		if c.KeyId != id || c.FormatVersion != chunkFormatGCM {
+			stale = append(stale, c)
+		}
+	}
+
+	for i, c := range stale {
+		if err = rotateChunk(db, folder, keys, c, logger); err != nil {
+			return errors.Wrapf(err, "rotateChunk %s", c.FileName)
+		}
+		if progress != nil {
+			progress(i+1, len(stale))
+		}
+	}
+	return nil
+}
+
+func rotateChunk(db *mdb.DB, folder string, keys *Keyring, c *ChunkDto, logger Logger) error {
+
+	codec, err := CodecByID(c.Codec)
+	if err != nil {
+		return err
+	}
+
+	id, key := keys.Current()
+	name := fmt.Sprintf("%012d.k%d.%s", c.StartPos, id, codec.Name())
+
+	loc := path.Join(folder, name)
+
+	size, err := reencryptChunk(path.Join(folder, c.FileName), loc+".tmp", keys, key, c)
+	if err != nil {
+		return errors.Wrap(err, "reencryptChunk")
+	}
+
+	if c.FormatVersion == chunkFormatCFB {
+		// legacy chunks are not authenticated, make sure
+		// they were decrypted with the right key
+		if err = checkRotated(loc+".tmp", keys, c, id); err != nil {
+			os.Remove(loc + ".tmp")
+			return errors.Wrap(err, "checkRotated")
+		}
+	}
+
+	if err = os.Rename(loc+".tmp", loc); err != nil {
+		return errors.Wrap(err, "Rename")
+	}
+	if err = crashPoint(crashRotateWritten); err != nil {
+		return err
+	}
+
+	var replaced bool
+
+	err = db.Update(func(tx *mdb.Tx) error {
+		current, err := lmdbGetChunk(tx, c.StartPos)
+		if err != nil {
+			return errors.Wrap(err, "lmdbGetChunk")
+		}
+		if current == nil || current.FileName != c.FileName {
+			// chunk was changed since we started
+			return nil
+		}
+		current.FileName = name
+		current.KeyId = id
+		current.FormatVersion = chunkFormatGCM
+		current.CompressedDiskSize = size
+
+		replaced = true
+		return lmdbPutChunk(tx, c.StartPos, current)
+	})
+	if err != nil {
+		return errors.Wrap(err, "db.Update")
+	}
+
+	if err = crashPoint(crashRotateCommitted); err != nil {
+		return err
+	}
+
+	old := c.FileName
+	if !replaced {
+		old = name
+	}
+	if err = os.Remove(path.Join(folder, old)); err != nil {
+		return errors.Wrap(err, "Remove")
+	}
+	if replaced {
+		logger.Printf("Re-encrypted chunk %s into %s", c.FileName, name)
+	}
+	return nil
+}
+
+// reencryptChunk copies the compressed content of the chunk into a new
+// file, sealing it with the key. Returns the size of the new file
+func reencryptChunk(src, dst string, keys *Keyring, key []byte, c *ChunkDto) (int64, error) {
+
+	var err error
+	var oldKey []byte
+	if oldKey, err = keys.Key(c.KeyId); err != nil {
+		return 0, err
+	}
+
+	var in *os.File
+	if in, err = os.Open(src); err != nil {
+		if os.IsNotExist(err) {
+			return 0, errors.Wrap(ErrChunkMissing, src)
+		}
+		return 0, errors.Wrap(err, "os.Open")
+	}
+	defer in.Close()
+
+	var decryptor io.Reader
+	if decryptor, err = chainChunkDecryptor(oldKey, c, in); err != nil {
+		return 0, errors.Wrap(err, "chainChunkDecryptor")
+	}
+
+	var out *os.File
+	if out, err = os.Create(dst); err != nil {
+		return 0, errors.Wrap(err, "os.Create")
+	}
+	defer out.Close()
+
+	buffer := bufio.NewWriter(out)
+
+	var encryptor io.WriteCloser
+	if encryptor, err = chainSealer(key, c.StartPos, buffer); err != nil {
+		return 0, errors.Wrap(err, "chainSealer")
+	}
+	if _, err = io.Copy(encryptor, decryptor); err != nil {
+		return 0, errors.Wrap(chunkError(err), "Copy")
+	}
+	if err = encryptor.Close(); err != nil {
+		return 0, errors.Wrap(err, "encryptor.Close")
+	}
+	if err = buffer.Flush(); err != nil {
+		return 0, errors.Wrap(err, "Flush")
+	}
+	if err = out.Sync(); err != nil {
+		return 0, errors.Wrap(err, "Sync")
+	}
+
+	var size int64
+	if size, err = out.Seek(0, io.SeekEnd); err != nil {
+		return 0, errors.Wrap(err, "Seek")
+	}
+	return size, out.Close()
+}
+
+func checkRotated(loc string, keys *Keyring, c *ChunkDto, id uint32) error {
+	rotated := *c
+	rotated.KeyId = id
+	rotated.FormatVersion = chunkFormatGCM
+
+	data := make([]byte, c.UncompressedByteSize)
+
+	var err error
+	if data, err = loadChunkIntoBuffer(loc, keys, &rotated, data); err != nil {
+		return err
+	}
+	return checkChunkChecksum(&rotated, data)
+}
@@ -0,0 +1,182 @@
+package cellar
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Authenticated chunks are sealed in segments, so that large chunks
+// could be streamed without holding them in memory. Each segment is
+// prefixed with the length of its ciphertext, the highest bit of the
+// length marks the last segment.
+//
+// Nonce of the segment is the random prefix of the chunk, followed by
+// the segment counter and the last segment flag. Reordering, dropping
+// or truncating segments breaks the authentication.
+const (
+	segmentSize     = 64 * 1024
+	noncePrefixSize = 7
+	lastSegmentFlag = 1 << 31
+)
+
+func segmentNonce(nonce []byte, counter uint32, last bool) []byte {
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[noncePrefixSize+4] = 0
+	if last {
+		nonce[noncePrefixSize+4] = 1
+	}
+	return nonce
+}
+
+type segmentWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	ad      []byte
+	nonce   []byte
+	counter uint32
+	// plaintext of the current segment
+	plain []byte
+	// header and ciphertext of the current segment
+	sealed []byte
+}
+
+func newSegmentWriter(aead cipher.AEAD, w io.Writer, prefix []byte, ad []byte) *segmentWriter {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	return &segmentWriter{
+		aead:   aead,
+		w:      w,
+		ad:     ad,
+		nonce:  nonce,
+		plain:  make([]byte, 0, segmentSize),
+		sealed: make([]byte, 4, 4+segmentSize+aead.Overhead()),
+	}
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// segment is sealed only when more data arrives,
+		// since the last one has to be flagged on Close
+		if len(s.plain) == segmentSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.plain[len(s.plain):segmentSize], p)
+		s.plain = s.plain[:len(s.plain)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *segmentWriter) seal(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("Too many segments in chunk")
+	}
+
+	nonce := segmentNonce(s.nonce, s.counter, last)
+	sealed := s.aead.Seal(s.sealed[:4], nonce, s.plain, s.ad)
+
+	header := uint32(len(sealed) - 4)
+	if last {
+		header |= lastSegmentFlag
+	}
+	binary.BigEndian.PutUint32(sealed, header)
+
+	if _, err := s.w.Write(sealed); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+	s.counter++
+	s.plain = s.plain[:0]
+	return nil
+}
+
+// Close seals the last segment. It doesn't close the underlying writer
+func (s *segmentWriter) Close() error {
+	return s.seal(true)
+}
+
+type segmentReader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	ad      []byte
+	nonce   []byte
+	counter uint32
+	last    bool
+	// decrypted bytes that were not read yet
+	plain []byte
+	buf   []byte
+}
+
+func newSegmentReader(aead cipher.AEAD, r io.Reader, prefix []byte, ad []byte) *segmentReader {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	return &segmentReader{
+		aead:  aead,
+		r:     r,
+		ad:    ad,
+		nonce: nonce,
+		buf:   make([]byte, segmentSize+aead.Overhead()),
+	}
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.last {
+			return 0, s.checkEnd()
+		}
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *segmentReader) open() error {
+	var header [4]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return errors.Wrapf(ErrAuthFailed, "segment %d is truncated: %s", s.counter, err)
+	}
+
+	h := binary.BigEndian.Uint32(header[:])
+	last := h&lastSegmentFlag != 0
+	size := int(h &^ lastSegmentFlag)
+
+	if size > len(s.buf) {
+		return errors.Wrapf(ErrAuthFailed, "segment %d has %d bytes", s.counter, size)
+	}
+	if _, err := io.ReadFull(s.r, s.buf[:size]); err != nil {
+		return errors.Wrapf(ErrAuthFailed, "segment %d is truncated: %s", s.counter, err)
+	}
+
+	nonce := segmentNonce(s.nonce, s.counter, last)
+	plain, err := s.aead.Open(s.buf[:0], nonce, s.buf[:size], s.ad)
+	if err != nil {
+		return errors.Wrapf(ErrAuthFailed, "segment %d", s.counter)
+	}
+
+	s.counter++
+	s.last = last
+	s.plain = plain
+	return nil
+}
+
+// checkEnd makes sure nothing follows the last segment
+func (s *segmentReader) checkEnd() error {
+	var b [1]byte
+	n, err := s.r.Read(b[:])
+	if n > 0 {
+		return errors.Wrap(ErrAuthFailed, "data past the last segment")
+	}
+	if err == nil || err == io.EOF {
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package cellar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// recordStream decodes records incrementally from the decryption and
+// decompression chain, so that the chunk never has to be in memory.
+// Streams are pooled, repeated scans reuse the read buffers.
+type recordStream struct {
+	r *bufio.Reader
+	// holds the current record and its checksum
+	buf []byte
+}
+
+const streamBufferSize = 64 * 1024
+
+var streamPool = sync.Pool{
+	New: func() interface{} {
+		return &recordStream{r: bufio.NewReaderSize(nil, streamBufferSize)}
+	},
+}
+
+func newRecordStream(src io.Reader) *recordStream {
+	s := streamPool.Get().(*recordStream)
+	s.r.Reset(src)
+	return s
+}
+
+func (s *recordStream) release() {
+	s.r.Reset(nil)
+	streamPool.Put(s)
+}
+
+// discard skips the bytes before the first record of interest
+func (s *recordStream) discard(n int64) error {
+	if _, err := io.CopyN(ioutil.Discard, s.r, n); err != nil {
+		return chunkError(err)
+	}
+	return nil
+}
+
+// replay passes the records between the global positions to the op.
+// Record bytes are reused, they are valid only within the op
+func (s *recordStream) replay(info *ReaderInfo, pos, end int64, op ReadOp, checksums bool) error {
+
+	for pos < end {
+
+		info.StartPos = pos
+
+		recordSize, err := binary.ReadVarint(s.r)
+		if err != nil {
+			return errors.Wrapf(chunkError(err), "Read varint at %d", pos)
+		}
+
+		// compared before adding, so a huge size can't overflow
+		left := end - pos - int64(varintSize(recordSize))
+		if checksums {
+			left -= recordChecksumSize
+		}
+		if recordSize < 0 || recordSize > left {
+			return errors.Wrapf(ErrCorruptRecord, "record at %d has %d bytes", pos, recordSize)
+		}
+
+		next := pos + int64(varintSize(recordSize)) + recordSize
+		size := recordSize
+		if checksums {
+			next += recordChecksumSize
+			size += recordChecksumSize
+		}
+
+		if int64(cap(s.buf)) < size {
+			s.buf = make([]byte, size)
+		}
+		buf := s.buf[:size]
+		if _, err = io.ReadFull(s.r, buf); err != nil {
+			return errors.Wrapf(chunkError(err), "Read %d bytes at %d", size, pos)
+		}
+
+		record := buf[:recordSize]
+		if checksums {
+			if err = checkRecordChecksum(record, buf[recordSize:]); err != nil {
+				return errors.Wrapf(err, "record at %d", pos)
+			}
+		}
+
+		info.NextPos = next
+
+		if err = op(info, record); err != nil {
+			return errors.Wrap(err, "Failed to execute op")
+		}
+		pos = next
+	}
+	return nil
+}
+
+// streamChunk replays the chunk starting from the offset without
+// loading it into memory. The chunk checksum is verified at the end,
+// after the records were delivered
+func streamChunk(loc string, keys *Keyring, c *ChunkDto, info *ReaderInfo, op ReadOp, offset int64) error {
+
+	var err error
+	var chunk *chunkStream
+
+	if chunk, err = openChunk(loc, keys, c); err != nil {
+		return errors.Wrapf(err, "openChunk %s", loc)
+	}
+	defer chunk.Close()
+
+	crc := crc32.New(crcTable)
+	s := newRecordStream(io.TeeReader(chunk, crc))
+	defer s.release()
+
+	if err = s.discard(offset); err != nil {
+		return errors.Wrapf(err, "Skip %d bytes in %s", offset, loc)
+	}
+
+	info.ChunkPos = c.StartPos
+	end := c.StartPos + c.UncompressedByteSize
+
+	if err = s.replay(info, c.StartPos+offset, end, op, c.RecordChecksums); err != nil {
+		return err
+	}
+
+	// read till the end, so that the checksum covers the whole
+	// chunk and the last segment gets authenticated
+	var tail int64
+	if tail, err = io.Copy(ioutil.Discard, s.r); err != nil {
+		return errors.Wrapf(chunkError(err), "Read the end of %s", loc)
+	}
+	if tail > 0 {
+		return errors.Wrapf(ErrCorruptChunk, "%d bytes past the end of %s", tail, loc)
+	}
+	if c.HasChecksum && crc.Sum32() != c.Checksum {
+		return errors.Wrapf(ErrChecksumMismatch, "chunk %s has %08x instead of %08x", c.FileName, crc.Sum32(), c.Checksum)
+	}
+	return nil
+}
+
+// streamBuffer replays the checkpointed part of the buffer starting
+// from the offset
+func streamBuffer(loc string, b *BufferDto, info *ReaderInfo, op ReadOp, offset int64) error {
+
+	var err error
+	var f *os.File
+
+	if f, err = os.Open(loc); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrap(ErrBufferMissing, loc)
+		}
+		return errors.Wrap(err, "os.Open")
+	}
+	defer f.Close()
+
+	s := newRecordStream(io.NewSectionReader(f, offset, b.Pos-offset))
+	defer s.release()
+
+	info.ChunkPos = b.StartPos
+	return s.replay(info, b.StartPos+offset, b.StartPos+b.Pos, op, b.RecordChecksums)
+}
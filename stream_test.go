@@ -0,0 +1,135 @@
+package cellar
+
+import (
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func scanInfos(t *testing.T, reader *Reader) []ReaderInfo {
+	var infos []ReaderInfo
+	var n int
+	err := reader.Scan(func(ri *ReaderInfo, data []byte) error {
+		if err := checkSeedBytes(data, n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		infos = append(infos, *ri)
+		n++
+		return nil
+	})
+	assert(t, err, "Scan")
+	return infos
+}
+
+func TestStreamingScan(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+	writeChecksummed(t, folder, key, 100)
+
+	whole := scanInfos(t, NewReader(folder, key))
+
+	reader := NewReader(folder, key)
+	reader.Flags |= RF_Stream
+	streamed := scanInfos(t, reader)
+
+	if len(streamed) != len(whole) || len(whole) != 100 {
+		t.Fatalf("Expected 100 records but got %d and %d", len(whole), len(streamed))
+	}
+	for i := range whole {
+		if whole[i] != streamed[i] {
+			t.Fatalf("Expected %v but got %v", whole[i], streamed[i])
+		}
+	}
+
+	// start in the middle of a chunk
+	reader.StartPos = whole[30].StartPos
+	var n int
+	err := reader.Scan(func(ri *ReaderInfo, data []byte) error {
+		if err := checkSeedBytes(data, 30+n); err != nil {
+			t.Fatalf("Failed seed check: %s", err)
+		}
+		n++
+		return nil
+	})
+	assert(t, err, "Scan")
+	if n != 70 {
+		t.Fatalf("Expected 70 records but got %d", n)
+	}
+}
+
+func TestStreamingScanFailures(t *testing.T) {
+	folder, key, _, chunks := writeSealed(t)
+
+	reader := NewReader(folder, key)
+	reader.Flags |= RF_Stream
+
+	flipByte(t, path.Join(folder, chunks[0].FileName), chunks[0].CompressedDiskSize/2)
+
+	err := reader.Scan(func(*ReaderInfo, []byte) error { return nil })
+	if errors.Cause(err) != ErrAuthFailed {
+		t.Fatalf("Expected ErrAuthFailed but got %v", err)
+	}
+}
+
+// benchmark store has 64MB in 4MB chunks
+var benchStore struct {
+	sync.Once
+	folder string
+	key    []byte
+}
+
+func getBenchStore(b *testing.B) (string, []byte) {
+	benchStore.Do(func() {
+		benchStore.folder = getFolder()
+		benchStore.key = genRandBytes(16)
+
+		w, err := NewWriter(benchStore.folder, 4*1024*1024, benchStore.key)
+		if err != nil {
+			b.Fatalf("NewWriter: %s", err)
+		}
+		defer w.Close()
+
+		record := genSeedBytes(1000, 1)
+		for i := 0; i < 64*1024; i++ {
+			if _, err = w.Append(record); err != nil {
+				b.Fatalf("Append: %s", err)
+			}
+		}
+		if _, err = w.Checkpoint(); err != nil {
+			b.Fatalf("Checkpoint: %s", err)
+		}
+	})
+	return benchStore.folder, benchStore.key
+}
+
+func benchmarkScan(b *testing.B, flags ReadFlag) {
+	folder, key := getBenchStore(b)
+
+	reader := NewReader(folder, key)
+	reader.Flags |= flags
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var bytes int64
+		err := reader.Scan(func(ri *ReaderInfo, data []byte) error {
+			bytes += int64(len(data))
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("Scan: %s", err)
+		}
+		b.SetBytes(bytes)
+	}
+}
+
+func BenchmarkScanWholeChunks(b *testing.B) {
+	benchmarkScan(b, RF_None)
+}
+
+func BenchmarkScanStream(b *testing.B) {
+	benchmarkScan(b, RF_Stream)
+}
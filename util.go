@@ -18,7 +18,7 @@ func ensureFolder(folder string) (err error) {
 
 	if os.IsNotExist(err) {
 		// file does not exist - create
-		if err = os.MkdirAll(folder, 0644); err != nil {
+		if err = os.MkdirAll(folder, 0755); err != nil {
 			return errors.Wrap(err, "MkdirAll")
 		}
 		return nil
@@ -0,0 +1,175 @@
+package cellar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+// DamagedRange is a range of global positions that can't be read back
+type DamagedRange struct {
+	// File is the chunk or buffer file containing the range
+	File string
+	// StartPos is the global position where the damage starts
+	StartPos int64
+	// EndPos is the global position where the damage ends (exclusive)
+	EndPos int64
+	Reason string
+}
+
+// VerifyReport is the outcome of checking all chunks and the buffer
+type VerifyReport struct {
+	Chunks  int
+	Records int64
+	// Bytes is the total uncompressed size of the verified data
+	Bytes   int64
+	Damaged []DamagedRange
+}
+
+// OK returns true if no damage was found
+func (r *VerifyReport) OK() bool {
+	return len(r.Damaged) == 0
+}
+
+func (r *VerifyReport) damage(file string, start, end int64, reason string) {
+	r.Damaged = append(r.Damaged, DamagedRange{file, start, end, reason})
+}
+
+// Verify walks every chunk and the checkpointed part of the buffer,
+// checking the checksums and the record framing. Damage is reported
+// instead of failing the walk, error is returned only if the
+// metadata DB can't be read.
+func Verify(folder string, key []byte) (*VerifyReport, error) {
+	keys, err := singleKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return VerifyWithKeyring(folder, keys)
+}
+
+// VerifyWithKeyring is Verify for the stores with multiple keys
+func VerifyWithKeyring(folder string, keys *Keyring) (*VerifyReport, error) {
+
+	var db *mdb.DB
+	var err error
+
+	cfg := mdb.NewConfig()
+	if db, err = mdb.New(folder, cfg); err != nil {
+		return nil, errors.Wrap(err, "mdb.New")
+	}
+
+	defer db.Close()
+
+	var b *BufferDto
+	var chunks []*ChunkDto
+
+	err = db.Read(func(tx *mdb.Tx) error {
+		var err error
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return errors.Wrap(err, "lmdbGetBuffer")
+		}
+		if chunks, err = lmdbListChunks(tx); err != nil {
+			return errors.Wrap(err, "lmdbListChunks")
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "db.Read")
+	}
+
+	report := &VerifyReport{}
+
+	for _, c := range chunks {
+
+		report.Chunks++
+		report.Bytes += c.UncompressedByteSize
+
+		end := c.StartPos + c.UncompressedByteSize
+
+		data := make([]byte, c.UncompressedByteSize)
+		loc := path.Join(folder, c.FileName)
+
+		if data, err = loadChunkIntoBuffer(loc, keys, c, data); err != nil {
+			report.damage(c.FileName, c.StartPos, end, err.Error())
+			continue
+		}
+
+		damaged := len(report.Damaged)
+		records := verifyRecords(report, c.FileName, c.StartPos, data, c.RecordChecksums)
+
+		if len(report.Damaged) > damaged {
+			continue
+		}
+
+		// damage that could not be attributed to records
+		if err = checkChunkChecksum(c, data); err != nil {
+			report.damage(c.FileName, c.StartPos, end, err.Error())
+		} else if records != c.Records {
+			reason := fmt.Sprintf("expected %d records but found %d", c.Records, records)
+			report.damage(c.FileName, c.StartPos, end, reason)
+		}
+	}
+
+	if b != nil && b.Pos > 0 {
+
+		report.Bytes += b.Pos
+
+		end := b.StartPos + b.Pos
+
+		var data []byte
+		if data, err = loadBufferFile(path.Join(folder, b.FileName), make([]byte, b.Pos)); err != nil {
+			report.damage(b.FileName, b.StartPos, end, err.Error())
+		} else {
+			verifyRecords(report, b.FileName, b.StartPos, data, b.RecordChecksums)
+		}
+	}
+
+	return report, nil
+}
+
+// verifyRecords walks the framing of the records without trusting it.
+// Records with bad checksums are reported individually, broken framing
+// damages everything up to the end of the data
+func verifyRecords(report *VerifyReport, file string, startPos int64, data []byte, checksums bool) (records int64) {
+
+	max := int64(len(data))
+	var pos int64
+
+	for pos < max {
+
+		size, n := binary.Varint(data[pos:])
+
+		// compared before adding, so a huge size can't overflow
+		left := max - pos - int64(n)
+		if checksums {
+			left -= recordChecksumSize
+		}
+
+		if n <= 0 || size < 0 || size > left {
+			reason := fmt.Sprintf("broken record framing at %d", startPos+pos)
+			report.damage(file, startPos+pos, startPos+max, reason)
+			return records
+		}
+
+		next := pos + int64(n) + size
+		if checksums {
+			next += recordChecksumSize
+		}
+
+		records++
+		report.Records++
+
+		if checksums {
+			record := data[pos+int64(n) : pos+int64(n)+size]
+			if err := checkRecordChecksum(record, data[next-recordChecksumSize:next]); err != nil {
+				report.damage(file, startPos+pos, startPos+next, err.Error())
+			}
+		}
+		pos = next
+	}
+	return records
+}
@@ -0,0 +1,115 @@
+package cellar
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
+)
+
+func flipByte(t *testing.T, loc string, offset int64) {
+	f, err := os.OpenFile(loc, os.O_RDWR, 0644)
+	assert(t, err, "OpenFile")
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	assert(t, err, "ReadAt")
+	b[0] ^= 0xFF
+	_, err = f.WriteAt(b, offset)
+	assert(t, err, "WriteAt")
+}
+
+func writeChecksummed(t *testing.T, folder string, key []byte, count int) []rec {
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	w.EnableRecordChecksums()
+
+	var recs []rec
+	for i := 0; i < count; i++ {
+		recs = append(recs, rec{pos: w.VolatilePos(), seed: i, size: 64})
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+	return recs
+}
+
+func TestRecordChecksums(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	recs := writeChecksummed(t, folder, key, 40)
+
+	assertRecords(t, folder, key, len(recs))
+
+	reader := NewReader(folder, key)
+	for _, r := range recs {
+		data, _, err := reader.ReadAt(r.pos)
+		assert(t, err, "ReadAt")
+		assert(t, checkSeedBytes(data, r.seed), "checkSeedBytes")
+	}
+
+	report, err := Verify(folder, key)
+	assert(t, err, "Verify")
+
+	if !report.OK() || report.Records != int64(len(recs)) || report.Chunks == 0 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func TestVerifyReportsDamage(t *testing.T) {
+
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	recs := writeChecksummed(t, folder, key, 40)
+
+	var b *BufferDto
+	var chunks []*ChunkDto
+
+	reader := NewReader(folder, key)
+	err := reader.ReadDB(func(tx *mdb.Tx) error {
+		var err error
+		if b, err = lmdbGetBuffer(tx); err != nil {
+			return err
+		}
+		chunks, err = lmdbListChunks(tx)
+		return err
+	})
+	assert(t, err, "ReadDB")
+
+	// damage the payload of the last record in the buffer
+	last := recs[len(recs)-1]
+	flipByte(t, path.Join(folder, b.FileName), last.pos-b.StartPos+10)
+
+	// and the middle of the first chunk
+	flipByte(t, path.Join(folder, chunks[0].FileName), chunks[0].CompressedDiskSize/2)
+
+	report, err := Verify(folder, key)
+	assert(t, err, "Verify")
+
+	if len(report.Damaged) != 2 {
+		t.Fatalf("Expected 2 damaged ranges but got %+v", report.Damaged)
+	}
+
+	chunk := report.Damaged[0]
+	if chunk.File != chunks[0].FileName || chunk.StartPos < chunks[0].StartPos {
+		t.Fatalf("Unexpected chunk damage %+v", chunk)
+	}
+
+	record := report.Damaged[1]
+	if record.StartPos != last.pos || record.EndPos != b.StartPos+b.Pos {
+		t.Fatalf("Unexpected record damage %+v", record)
+	}
+
+	if _, _, err = reader.ReadAt(last.pos); errors.Cause(err) != ErrChecksumMismatch {
+		t.Fatalf("Expected checksum mismatch but got %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package cellar
 import (
 	"encoding/binary"
 	fmt "fmt"
-	"log"
 	"os"
 	"path"
 
@@ -13,30 +12,112 @@ import (
 
 type Writer struct {
 	db            *mdb.DB
+	lock          *folderLock
 	b             *Buffer
 	maxKeySize    int64
 	maxValSize    int64
 	folder        string
 	maxBufferSize int64
-	key           []byte
+	keys          *Keyring
+	keyCheck      []byte
 	encodingBuf   []byte
+	// framed records of the batch, reused between the calls
+	batchBuf []byte
+	// codec and level used to compress the new chunks
+	codec Codec
+	level int
+	// append CRC-32C to the records of the new buffers
+	recordChecksums bool
+	mapSizeMbs      int64
+	dbFlags         uint
+	log             Logger
+	hooks           Hooks
+	retention       RetentionPolicy
+	rejectLarge     bool
+	// position of the first record that wasn't truncated
+	lowWaterMark int64
+	// index entries waiting for the next commit
+	pendingIndex []indexEntry
+	// user checkpoints waiting for the next commit
+	pendingCheckpoints map[string]int64
+	recovery           *RecoveryReport
+	closed             bool
 }
 
 func NewWriter(folder string, maxBufferSize int64, key []byte) (*Writer, error) {
-	ensureFolder(folder)
+	return NewWriterWithOptions(folder, Options{BufferSize: maxBufferSize, Key: key})
+}
+
+// NewWriterWithKeyring creates a writer that encrypts new chunks with
+// the current key of the keyring
+func NewWriterWithKeyring(folder string, maxBufferSize int64, keys *Keyring) (*Writer, error) {
+	return NewWriterWithOptions(folder, Options{BufferSize: maxBufferSize, Keys: keys})
+}
+
+// NewWriterWithOptions creates a writer configured by the options.
+// Options are saved in the metadata DB and validated against the
+// saved ones when the store is reopened
+func NewWriterWithOptions(folder string, opts Options) (*Writer, error) {
 
 	var db *mdb.DB
 	var err error
 
+	var keys *Keyring
+	if keys, err = opts.keyring(); err != nil {
+		return nil, err
+	}
+	if err = ensureFolder(folder); err != nil {
+		return nil, errors.Wrap(err, "ensureFolder")
+	}
+
+	// only one writer could own the folder
+	var lock *folderLock
+	if lock, err = lockFolder(folder); err != nil {
+		return nil, err
+	}
+
 	cfg := mdb.NewConfig()
-	// make sure we are writing sync
-	cfg.EnvFlags = 0
+	// make sure we are writing sync, unless asked otherwise
+	cfg.EnvFlags = opts.DBFlags
+	if opts.MapSizeMbs > 0 {
+		cfg.SizeMbs = opts.MapSizeMbs
+	}
 
 	if db, err = mdb.New(folder, cfg); err != nil {
+		lock.release()
 		return nil, errors.Wrap(err, "mdb.New")
 	}
 
 	var meta *MetaDto
+	err = db.Read(func(tx *mdb.Tx) error {
+		var err error
+		meta, err = lmdbGetCellarMeta(tx)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		lock.release()
+		return nil, errors.Wrap(err, "lmdbGetCellarMeta")
+	}
+
+	if err = opts.inherit(meta, keys); err == nil {
+		if err = opts.check(); err == nil {
+			err = opts.applyDB(db, cfg)
+		}
+	}
+	if err != nil {
+		db.Close()
+		lock.release()
+		return nil, errors.Wrap(err, "options")
+	}
+
+	var report *RecoveryReport
+	if report, err = recoverFolder(db, folder, opts.BufferSize, opts.Logger); err != nil {
+		db.Close()
+		lock.release()
+		return nil, errors.Wrap(err, "recoverFolder")
+	}
+
 	var b *Buffer
 
 	err = db.Update(func(tx *mdb.Tx) error {
@@ -48,43 +129,110 @@ func NewWriter(folder string, maxBufferSize int64, key []byte) (*Writer, error)
 		}
 
 		if dto == nil {
-			if b, err = createBuffer(tx, 0, maxBufferSize, folder); err != nil {
+			if b, err = createBuffer(tx, 0, opts.BufferSize, folder, opts.RecordChecksums); err != nil {
 				return errors.Wrap(err, "SetNewBuffer")
 			}
 			return nil
-
-		} else if b, err = openBuffer(dto, folder); err != nil {
-			return errors.Wrap(err, "openBuffer")
 		}
-
-		if meta, err = lmdbGetCellarMeta(tx); err != nil {
-			return errors.Wrap(err, "lmdbGetCellarMeta")
+		if b, err = openBuffer(dto, folder); err != nil {
+			return errors.Wrap(err, "openBuffer")
 		}
 		return nil
 	})
 
 	if err != nil {
+		db.Close()
+		lock.release()
 		return nil, errors.Wrap(err, "Update")
 	}
 
+	_, key := keys.Current()
+
 	wr := &Writer{
 		folder:        folder,
-		maxBufferSize: maxBufferSize,
-		key:           key,
+		maxBufferSize: opts.BufferSize,
+		keys:          keys,
+		keyCheck:      keyCheck(key),
 		encodingBuf:   make([]byte, binary.MaxVarintLen64),
+		codec:         opts.Codec,
+		level:         opts.Level,
+		mapSizeMbs:    opts.MapSizeMbs,
+		dbFlags:       opts.DBFlags,
+		log:           opts.Logger,
+		hooks:         opts.Hooks,
+		retention:     opts.Retention,
+		rejectLarge:   opts.RejectLargeRecords,
 		db:            db,
+		lock:          lock,
 		b:             b,
+		recovery:      report,
+
+		recordChecksums: b.recordChecksums,
+	}
+
+	if opts.RecordChecksums {
+		wr.EnableRecordChecksums()
 	}
 
 	if meta != nil {
 		wr.maxKeySize = meta.MaxKeySize
 		wr.maxValSize = meta.MaxValSize
+		wr.lowWaterMark = meta.LowWaterMark
+	}
+
+	if !report.Clean() && wr.hooks.OnRecovery != nil {
+		wr.hooks.OnRecovery(report)
+	}
+
+	if report.Resealed {
+		if err = wr.SealTheBuffer(); err != nil {
+			wr.CloseWithoutCheckpoint()
+			return nil, errors.Wrap(err, "SealTheBuffer")
+		}
+	}
+
+	// persist the options right away, so that they
+	// are validated even if nothing gets written
+	err = db.Update(func(tx *mdb.Tx) error {
+		return lmdbSetCellarMeta(tx, wr.getMeta())
+	})
+	if err != nil {
+		wr.CloseWithoutCheckpoint()
+		return nil, errors.Wrap(err, "lmdbSetCellarMeta")
 	}
 
 	return wr, nil
 
 }
 
+// EnableRecordChecksums makes the writer store CRC-32C after each record,
+// so that the corruption could be pinned down to the individual records.
+// Setting applies to the current buffer if it is still empty, otherwise
+// it takes effect from the next buffer.
+func (w *Writer) EnableRecordChecksums() {
+	w.recordChecksums = true
+	if w.b.pos == 0 {
+		w.b.recordChecksums = true
+	}
+}
+
+// SetCodec picks the codec and its level for the chunks sealed from
+// now on. Existing chunks keep their codec, readers handle the mix.
+func (w *Writer) SetCodec(codec Codec, level int) error {
+	if err := checkCodec(codec, level); err != nil {
+		return err
+	}
+	w.codec = codec
+	w.level = level
+	return nil
+}
+
+// Recovery returns the report of repairs that were needed
+// to open this writer after an unclean shutdown
+func (w *Writer) Recovery() *RecoveryReport {
+	return w.recovery
+}
+
 func (w *Writer) VolatilePos() int64 {
 	if w.b != nil {
 		return w.b.startPos + w.b.pos
@@ -94,15 +242,20 @@ func (w *Writer) VolatilePos() int64 {
 
 func (w *Writer) Append(data []byte) (pos int64, err error) {
 
+	if err = w.checkOpen(); err != nil {
+		return 0, err
+	}
+
 	dataLen := int64(len(data))
 	n := binary.PutVarint(w.encodingBuf, dataLen)
 
 	totalSize := n + len(data)
+	if w.recordChecksums || w.b.recordChecksums {
+		totalSize += recordChecksumSize
+	}
 
-	if !w.b.fits(int64(totalSize)) {
-		if err = w.SealTheBuffer(); err != nil {
-			return 0, errors.Wrap(err, "SealTheBuffer")
-		}
+	if err = w.reserve(totalSize); err != nil {
+		return 0, err
 	}
 
 	if err = w.b.writeBytes(w.encodingBuf[0:n]); err != nil {
@@ -111,6 +264,11 @@ func (w *Writer) Append(data []byte) (pos int64, err error) {
 	if err = w.b.writeBytes(data); err != nil {
 		return 0, errors.Wrap(err, "write body")
 	}
+	if w.b.recordChecksums {
+		if err = w.b.writeBytes(putRecordChecksum(w.encodingBuf, data)); err != nil {
+			return 0, errors.Wrap(err, "write checksum")
+		}
+	}
 
 	w.b.endRecord()
 
@@ -124,7 +282,36 @@ func (w *Writer) Append(data []byte) (pos int64, err error) {
 	return pos, nil
 }
 
-func createBuffer(tx *mdb.Tx, startPos int64, maxSize int64, folder string) (*Buffer, error) {
+// reserve makes room in the buffer for the framed record, sealing
+// the buffer if needed. Record that is larger than the buffer gets an
+// empty buffer grown to fit it. Such buffer is full after the record,
+// so the record ends up in its own chunk.
+func (w *Writer) reserve(size int) error {
+
+	if w.b.fits(int64(size)) {
+		return nil
+	}
+
+	if int64(size) <= w.maxBufferSize {
+		if err := w.SealTheBuffer(); err != nil {
+			return errors.Wrap(err, "SealTheBuffer")
+		}
+		return nil
+	}
+
+	if w.rejectLarge {
+		return errors.Wrapf(ErrRecordTooLarge, "%d bytes with the buffer of %d", size, w.maxBufferSize)
+	}
+	if w.b.pos > 0 {
+		if err := w.SealTheBuffer(); err != nil {
+			return errors.Wrap(err, "SealTheBuffer")
+		}
+	}
+	w.b.grow(int64(size))
+	return nil
+}
+
+func createBuffer(tx *mdb.Tx, startPos int64, maxSize int64, folder string, recordChecksums bool) (*Buffer, error) {
 	name := fmt.Sprintf("%012d", startPos)
 	dto := &BufferDto{
 		Pos:      0,
@@ -132,6 +319,8 @@ func createBuffer(tx *mdb.Tx, startPos int64, maxSize int64, folder string) (*Bu
 		MaxBytes: maxSize,
 		Records:  0,
 		FileName: name,
+
+		RecordChecksums: recordChecksums,
 	}
 	var err error
 	var buf *Buffer
@@ -151,30 +340,47 @@ func (w *Writer) SealTheBuffer() error {
 
 	var err error
 
+	if err = w.checkOpen(); err != nil {
+		return err
+	}
+
 	oldBuffer := w.b
 	var newBuffer *Buffer
 
 	if err = oldBuffer.flush(); err != nil {
 		return errors.Wrap(err, "buffer.Flush")
 	}
+	if err = crashPoint(crashSealFlushed); err != nil {
+		return err
+	}
 
 	var dto *ChunkDto
 
-	if dto, err = oldBuffer.compress(w.key); err != nil {
+	keyID, key := w.keys.Current()
+
+	if dto, err = oldBuffer.compress(key, w.codec, w.level); err != nil {
 		return errors.Wrap(err, "compress")
 	}
+	dto.KeyId = keyID
+	if err = crashPoint(crashSealCompressed); err != nil {
+		return err
+	}
 
 	newStartPos := dto.StartPos + dto.UncompressedByteSize
 
 	err = w.db.Update(func(tx *mdb.Tx) error {
 
-		if err = lmdbAddChunk(tx, dto.StartPos, dto); err != nil {
-			return errors.Wrap(err, "lmdbAddChunk")
+		if err = lmdbPutChunk(tx, dto.StartPos, dto); err != nil {
+			return errors.Wrap(err, "lmdbPutChunk")
 		}
 
-		if newBuffer, err = createBuffer(tx, newStartPos, w.maxBufferSize, w.folder); err != nil {
+		if newBuffer, err = createBuffer(tx, newStartPos, w.maxBufferSize, w.folder, w.recordChecksums); err != nil {
 			return errors.Wrap(err, "createBuffer")
 		}
+		// sealed data is durable, so are the pending updates
+		if err = w.putPending(tx); err != nil {
+			return errors.Wrap(err, "putPending")
+		}
 		return nil
 
 	})
@@ -183,37 +389,110 @@ func (w *Writer) SealTheBuffer() error {
 		return errors.Wrap(err, "w.db.Update")
 	}
 
+	w.clearPending()
+
 	w.b = newBuffer
 
+	w.log.Printf("Added chunk %s with %d records and %d bytes (%d compressed)", dto.FileName, dto.Records, dto.UncompressedByteSize, dto.CompressedDiskSize)
+	if w.hooks.OnSeal != nil {
+		w.hooks.OnSeal(dto)
+	}
+
+	if err = crashPoint(crashSealCommitted); err != nil {
+		return err
+	}
+
 	oldBufferPath := path.Join(w.folder, oldBuffer.fileName)
 
 	if err = os.Remove(oldBufferPath); err != nil {
-		log.Printf("Can't remove old buffer %s: %s", oldBufferPath, err)
+		w.log.Printf("Can't remove old buffer %s: %s", oldBufferPath, err)
+	}
+
+	// seal is committed already, so the failed cleanup doesn't fail
+	// the append. Retention is retried on the next seal
+	if !w.retention.empty() {
+		if _, err = w.ApplyRetention(w.retention); err != nil {
+			w.log.Printf("Can't apply retention: %s", err)
+			if w.hooks.OnRetentionError != nil {
+				w.hooks.OnRetentionError(err)
+			}
+		}
 	}
 	return nil
 
 }
 
 // Close disposes all resources
+// Close checkpoints the records appended so far and releases the
+// buffer file, the metadata DB and the folder lock. Writer fails with
+// ErrClosed afterwards, repeated Close calls do nothing.
 func (w *Writer) Close() error {
 
-	// TODO: flush, checkpoint and close current buffer
-	return w.db.Close()
+	if w.closed {
+		return nil
+	}
+
+	_, err := w.Checkpoint()
+	if rerr := w.release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// CloseWithoutCheckpoint closes the writer, discarding the records
+// appended since the last checkpoint
+func (w *Writer) CloseWithoutCheckpoint() error {
+	if w.closed {
+		return nil
+	}
+	return w.release()
+}
+
+func (w *Writer) release() error {
+
+	w.closed = true
+
+	err := w.b.close()
+	if derr := w.db.Close(); err == nil {
+		err = derr
+	}
+	if lerr := w.lock.release(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+func (w *Writer) checkOpen() error {
+	if w.closed {
+		return ErrClosed
+	}
+	return nil
 }
 
 // ReadDB allows to execute read transaction against
 // the meta database
 func (w *Writer) ReadDB(op mdb.TxOp) error {
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
 	return w.db.Read(op)
 }
 
 // Write DB allows to execute write transaction against
 // the meta database
 func (w *Writer) UpdateDB(op mdb.TxOp) error {
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
 	return w.db.Update(op)
 }
 
+// PutUserCheckpoint saves the checkpoint right away, in its own
+// transaction. Use StageUserCheckpoint to keep it in sync with the data
 func (w *Writer) PutUserCheckpoint(name string, pos int64) error {
+	if err := w.checkOpen(); err != nil {
+		return err
+	}
 	return w.db.Update(func(tx *mdb.Tx) error {
 		return lmdbPutUserCheckpoint(tx, name, pos)
 	})
@@ -221,6 +500,10 @@ func (w *Writer) PutUserCheckpoint(name string, pos int64) error {
 
 func (w *Writer) GetUserCheckpoint(name string) (int64, error) {
 
+	if err := w.checkOpen(); err != nil {
+		return 0, err
+	}
+
 	var pos int64
 	err := w.db.Read(func(tx *mdb.Tx) error {
 		p, e := lmdbGetUserCheckpoint(tx, name)
@@ -236,11 +519,42 @@ func (w *Writer) GetUserCheckpoint(name string) (int64, error) {
 	return pos, nil
 }
 
+// StageUserCheckpoint sets the checkpoint atomically with the data
+// appended so far. Like IndexPosition, it is committed by the next
+// Checkpoint or buffer seal, whichever comes first. GetUserCheckpoint
+// returns the committed value until then.
+func (w *Writer) StageUserCheckpoint(name string, pos int64) {
+	if w.pendingCheckpoints == nil {
+		w.pendingCheckpoints = make(map[string]int64)
+	}
+	w.pendingCheckpoints[name] = pos
+}
+
 func (w *Writer) Checkpoint() (int64, error) {
-	w.b.flush()
+	return w.CheckpointWith(nil)
+}
+
+// CheckpointWith is Checkpoint that also runs the op within its
+// transaction, so that custom updates are committed together with the
+// data. Failure of the op aborts the checkpoint. Note, that the buffer
+// seals commit the data without the op, stage user checkpoints and
+// index entries if they must never get ahead or behind the data.
+func (w *Writer) CheckpointWith(op mdb.TxOp) (int64, error) {
 
 	var err error
 
+	if err = w.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if err = w.b.flush(); err != nil {
+		return 0, errors.Wrap(err, "flush")
+	}
+
+	if err = crashPoint(crashCheckpointFlushed); err != nil {
+		return 0, err
+	}
+
 	dto := w.b.getState()
 
 	current := dto.StartPos + dto.Pos
@@ -252,14 +566,15 @@ func (w *Writer) Checkpoint() (int64, error) {
 			return errors.Wrap(err, "lmdbPutBuffer")
 		}
 
-		meta := &MetaDto{
-			MaxKeySize: w.maxKeySize,
-			MaxValSize: w.maxValSize,
-		}
-
-		if err = lmdbSetCellarMeta(tx, meta); err != nil {
+		if err = lmdbSetCellarMeta(tx, w.getMeta()); err != nil {
 			return errors.Wrap(err, "lmdbSetCellarMeta")
 		}
+		if err = w.putPending(tx); err != nil {
+			return errors.Wrap(err, "putPending")
+		}
+		if op != nil {
+			return op(tx)
+		}
 		return nil
 
 	})
@@ -268,6 +583,84 @@ func (w *Writer) Checkpoint() (int64, error) {
 		return 0, errors.Wrap(err, "txn.Update")
 	}
 
+	w.clearPending()
+
+	if w.hooks.OnCheckpoint != nil {
+		w.hooks.OnCheckpoint(current)
+	}
+
 	return current, nil
 
 }
+
+// Rollback discards the records appended since the last commit of the
+// data: Checkpoint or the buffer seal. Staged index entries and user
+// checkpoints are discarded too. Returns the position that the writer
+// is back at.
+func (w *Writer) Rollback() (int64, error) {
+
+	var err error
+
+	if err = w.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	var dto *BufferDto
+	err = w.db.Read(func(tx *mdb.Tx) error {
+		var err error
+		dto, err = lmdbGetBuffer(tx)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "lmdbGetBuffer")
+	}
+	if dto == nil || dto.FileName != w.b.fileName {
+		return 0, errors.Errorf("Buffer %s is not committed", w.b.fileName)
+	}
+
+	if err = w.b.rollback(dto); err != nil {
+		return 0, errors.Wrap(err, "rollback")
+	}
+	w.clearPending()
+	return dto.StartPos + dto.Pos, nil
+}
+
+// getMeta captures the statistics and the options of the writer
+func (w *Writer) getMeta() *MetaDto {
+	id, _ := w.keys.Current()
+	return &MetaDto{
+		MaxKeySize:      w.maxKeySize,
+		MaxValSize:      w.maxValSize,
+		BufferSize:      w.maxBufferSize,
+		Codec:           w.codec.ID(),
+		Level:           int32(w.level),
+		RecordChecksums: w.recordChecksums,
+		MapSizeMbs:      w.mapSizeMbs,
+		DbFlags:         uint32(w.dbFlags),
+		KeyId:           id,
+		KeyCheck:        w.keyCheck,
+		LowWaterMark:    w.lowWaterMark,
+	}
+}
+
+// putPending saves all staged updates within the transaction
+func (w *Writer) putPending(tx *mdb.Tx) error {
+	for _, e := range w.pendingIndex {
+		if err := lmdbIndexPosition(tx, e.stream, e.key, e.pos); err != nil {
+			return errors.Wrap(err, "lmdbIndexPosition")
+		}
+	}
+	for name, pos := range w.pendingCheckpoints {
+		if err := lmdbPutUserCheckpoint(tx, name, pos); err != nil {
+			return errors.Wrap(err, "lmdbPutUserCheckpoint")
+		}
+	}
+	return nil
+}
+
+func (w *Writer) clearPending() {
+	w.pendingIndex = w.pendingIndex[:0]
+	for name := range w.pendingCheckpoints {
+		delete(w.pendingCheckpoints, name)
+	}
+}
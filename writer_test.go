@@ -8,6 +8,9 @@ import (
 	rnd "math/rand"
 	"testing"
 	"time"
+
+	"github.com/abdullin/mdb"
+	"github.com/pkg/errors"
 )
 
 func genRandBytes(size int) []byte {
@@ -117,6 +120,117 @@ func assertCheckpoint(t *testing.T, w *Writer) {
 	}
 }
 
+func TestCloseCheckpoints(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	for i := 0; i < 20; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	closeWriter(t, w)
+	// repeated close does nothing
+	closeWriter(t, w)
+
+	if _, err = w.Append(genSeedBytes(64, 20)); errors.Cause(err) != ErrClosed {
+		t.Fatalf("Expected ErrClosed from Append but got %v", err)
+	}
+	if _, err = w.Checkpoint(); errors.Cause(err) != ErrClosed {
+		t.Fatalf("Expected ErrClosed from Checkpoint but got %v", err)
+	}
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	if !w.Recovery().Clean() {
+		t.Fatalf("Expected clean reopen but got %+v", w.Recovery())
+	}
+	assertRecords(t, folder, key, 20)
+
+	// abort discards the appends since the checkpoint
+	for i := 20; i < 25; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assert(t, w.CloseWithoutCheckpoint(), "CloseWithoutCheckpoint")
+	if _, err = w.Append(genSeedBytes(64, 25)); errors.Cause(err) != ErrClosed {
+		t.Fatalf("Expected ErrClosed after abort but got %v", err)
+	}
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+	assertRecords(t, folder, key, 20)
+}
+
+func TestRollback(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	for i := 0; i < 10; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	checkpoint, err := w.Checkpoint()
+	assert(t, err, "Checkpoint")
+
+	// failed import batch
+	for i := 0; i < 5; i++ {
+		_, err = w.Append(genSeedBytes(64, 100+i))
+		assert(t, err, "Append")
+	}
+	assert(t, w.IndexPosition("batch", 1, checkpoint), "IndexPosition")
+	w.StageUserCheckpoint("remote", 5)
+
+	pos, err := w.Rollback()
+	assert(t, err, "Rollback")
+	if pos != checkpoint || w.VolatilePos() != checkpoint {
+		t.Fatalf("Expected rollback to %d but got %d", checkpoint, pos)
+	}
+
+	for i := 10; i < 20; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+	}
+	assertCheckpoint(t, w)
+
+	// seal commits the data as well
+	n := 20
+	for start := w.b.startPos; w.b.startPos == start; n++ {
+		_, err = w.Append(genSeedBytes(64, n))
+		assert(t, err, "Append")
+	}
+	sealed := w.b.startPos
+	_, err = w.Append(genSeedBytes(64, 200))
+	assert(t, err, "Append")
+
+	if pos, err = w.Rollback(); err != nil || pos != sealed {
+		t.Fatalf("Expected rollback to the seal at %d but got %d, %v", sealed, pos, err)
+	}
+	// the record that triggered the seal was in the new buffer
+	n--
+	closeWriter(t, w)
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+	if !w.Recovery().Clean() {
+		t.Fatalf("Expected clean reopen but got %+v", w.Recovery())
+	}
+	assertRecords(t, folder, key, n)
+
+	if cp, err := w.GetUserCheckpoint("remote"); err != nil || cp != 0 {
+		t.Fatalf("Expected staged checkpoint to be discarded but got %d, %v", cp, err)
+	}
+	if _, found, err := NewReader(folder, key).Lookup("batch", 1); err != nil || found {
+		t.Fatalf("Expected staged index entry to be discarded, got %v, %v", found, err)
+	}
+}
+
 func TestUserCheckpoints(t *testing.T) {
 
 	var (
@@ -149,6 +263,128 @@ func TestUserCheckpoints(t *testing.T) {
 
 }
 
+func TestStagedUserCheckpoints(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	// import job stores its remote offset along with every record
+	for i := 0; i < 5; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+		w.StageUserCheckpoint("remote", int64(i+1))
+	}
+	pos, err := w.GetUserCheckpoint("remote")
+	if err != nil || pos != 0 {
+		t.Fatalf("Expected staged checkpoint to be invisible but got %d, %v", pos, err)
+	}
+
+	// failed op aborts the whole checkpoint
+	fail := errors.New("fail")
+	if _, err = w.CheckpointWith(func(tx *mdb.Tx) error { return fail }); errors.Cause(err) != fail {
+		t.Fatalf("Expected op error but got %v", err)
+	}
+	_, err = w.CheckpointWith(func(tx *mdb.Tx) error {
+		return lmdbPutUserCheckpoint(tx, "custom", 42)
+	})
+	assert(t, err, "CheckpointWith")
+
+	for name, expected := range map[string]int64{"remote": 5, "custom": 42} {
+		if pos, err = w.GetUserCheckpoint(name); err != nil || pos != expected {
+			t.Fatalf("Expected %s at %d but got %d, %v", name, expected, pos, err)
+		}
+	}
+
+	// seals commit the checkpoint that matches the sealed data
+	for i := 5; i < 40; i++ {
+		_, err = w.Append(genSeedBytes(64, i))
+		assert(t, err, "Append")
+		w.StageUserCheckpoint("remote", int64(i+1))
+	}
+	abandon(w)
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+	defer closeWriter(t, w)
+
+	pos, err = w.GetUserCheckpoint("remote")
+	assert(t, err, "GetUserCheckpoint")
+	if pos <= 5 {
+		t.Fatalf("Expected the seal to commit the checkpoint but got %d", pos)
+	}
+	assertRecords(t, folder, key, int(pos))
+}
+
+func TestLargeRecords(t *testing.T) {
+	folder := getFolder()
+	key := genRandBytes(16)
+
+	w, err := NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	sizes := []int{64, 5000, 64, 64, 3000}
+	for i, size := range sizes[:2] {
+		_, err = w.Append(genSeedBytes(size, i))
+		assert(t, err, "Append")
+	}
+	// full buffer with the large record survives the reopen
+	assertCheckpoint(t, w)
+	abandon(w)
+
+	w, err = NewWriter(folder, 1000, key)
+	assert(t, err, "NewWriter")
+
+	var batch [][]byte
+	for i, size := range sizes[2:] {
+		batch = append(batch, genSeedBytes(size, i+2))
+	}
+	_, err = w.AppendBatch(batch)
+	assert(t, err, "AppendBatch")
+	assertCheckpoint(t, w)
+
+	for _, flags := range []ReadFlag{RF_LoadBuffer, RF_LoadBuffer | RF_Stream} {
+		reader := NewReader(folder, key)
+		reader.Flags = flags
+		var n int
+		err = reader.Scan(func(ri *ReaderInfo, data []byte) error {
+			if len(data) != sizes[n] {
+				t.Fatalf("Expected record %d to have %d bytes but got %d", n, sizes[n], len(data))
+			}
+			if err := checkSeedBytes(data, n); err != nil {
+				t.Fatalf("Failed seed check: %s", err)
+			}
+			n++
+			return nil
+		})
+		assert(t, err, "Scan")
+		if n != len(sizes) {
+			t.Fatalf("Expected %d records but got %d", len(sizes), n)
+		}
+	}
+
+	keys, err := singleKey(key)
+	assert(t, err, "singleKey")
+	for _, c := range listChunks(t, folder, keys) {
+		if c.UncompressedByteSize > 1000 && c.Records != 1 {
+			t.Fatalf("Expected large chunk %s to hold a single record", c.FileName)
+		}
+	}
+
+	// hard error mode leaves the writer intact
+	closeWriter(t, w)
+	w, err = NewWriterWithOptions(folder, Options{Key: key, RejectLargeRecords: true})
+	assert(t, err, "NewWriterWithOptions")
+	if _, err = w.Append(genSeedBytes(2000, 0)); errors.Cause(err) != ErrRecordTooLarge {
+		t.Fatalf("Expected ErrRecordTooLarge but got %v", err)
+	}
+	_, err = w.Append(genSeedBytes(64, len(sizes)))
+	assert(t, err, "Append")
+	assertCheckpoint(t, w)
+	closeWriter(t, w)
+}
+
 func TestSingleChunkDB(t *testing.T) {
 
 	log.Print("Starting single chunk")